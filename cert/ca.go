@@ -0,0 +1,114 @@
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+var errNoCA = errors.New("no MITM root CA configured")
+
+// CA is the certificate authority that signs the leaf certificates
+// presented to clients in MITM mode.
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// NewCA checks that key is the private key of cert and that cert is
+// allowed to sign other certificates.
+func NewCA(cert *x509.Certificate, key crypto.Signer) (*CA, error) {
+	if cert == nil {
+		return nil, errors.New("CA certificate is nil")
+	}
+	if key == nil {
+		return nil, errors.New("CA private key is nil")
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate %q is not a CA", cert.Subject.CommonName)
+	}
+	certPub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("marshal CA certificate public key failed: %s", err)
+	}
+	keyPub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, fmt.Errorf("marshal CA private key public part failed: %s", err)
+	}
+	if !bytes.Equal(certPub, keyPub) {
+		return nil, fmt.Errorf("CA private key does not match certificate %q", cert.Subject.CommonName)
+	}
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// ParseCA parses a PEM encoded CA certificate and its private key.
+func ParseCA(certPEM, keyPEM []byte) (*CA, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded CA certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA certificate failed: %s", err)
+	}
+	key, err := ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA private key failed: %s", err)
+	}
+	return NewCA(cert, key)
+}
+
+// LoadCA reads a PEM encoded CA certificate and its private key from files.
+func LoadCA(certFile, keyFile string) (*CA, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCA(certPEM, keyPEM)
+}
+
+// BuiltinCA returns the CA shipped with this package.
+// Its private key is publicly known, so it should only be used for demos.
+func BuiltinCA() (*CA, error) {
+	return ParseCA(rootCAPem, rootKeyPem)
+}
+
+// ParsePrivateKeyPEM parses a PKCS#1, PKCS#8 or SEC 1 private key in PEM format.
+func ParsePrivateKeyPEM(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case *ecdsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+}
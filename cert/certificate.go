@@ -3,16 +3,15 @@ package cert
 import (
 	crand "crypto/rand"
 
-	"crypto/md5"
+	"crypto"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/hex"
 	"encoding/pem"
-	"fmt"
 	"math/big"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -106,33 +105,84 @@ bLBpLIyXUddQx8XAHeLRUtEMvY1q7O49Ruz1kHFuVrzUKzDJNU9Piqa8NtkSvApQ
 `)
 )
 
-var (
-	rootCA  *x509.Certificate
-	rootKey *rsa.PrivateKey
+// Default validity window of leaf certificates.
+const (
+	DefaultLeafBackdate = 24 * time.Hour
+	DefaultLeafValidity = 365 * 24 * time.Hour
 )
 
-func init() {
-	var err error
-	rootCA, err = loadRootCA()
-	if err != nil {
-		panic(fmt.Errorf("Load root ca failed: %s", err))
-	}
-	rootKey, err = loadRootKey()
-	if err != nil {
-		panic(fmt.Errorf("Load root key failed: %s", err))
-	}
+// LeafOptions controls how leaf certificates are generated.
+// The zero value generates a fresh ECDSA P-256 key for every host.
+type LeafOptions struct {
+	// KeyType is one of the Key* constants, KeyECDSAP256 by default.
+	KeyType string
+	// ReuseKey makes every leaf certificate share one private key,
+	// so that generating a certificate only costs a single signature.
+	ReuseKey bool
+	// Backdate and Validity define the window [now-Backdate, now+Validity].
+	// NotAfter never exceeds the NotAfter of the CA.
+	Backdate time.Duration
+	Validity time.Duration
+	// Organization and OrganizationalUnit are copied into the subject.
+	Organization       []string
+	OrganizationalUnit []string
+	// KeyUsage defaults to DigitalSignature, plus KeyEncipherment for RSA keys.
+	KeyUsage x509.KeyUsage
+	// ExtKeyUsage defaults to ServerAuth and ClientAuth.
+	ExtKeyUsage []x509.ExtKeyUsage
 }
 
 // Certificate .
 type Certificate struct {
+	ca    *CA
 	cache Cache
+	opts  LeafOptions
+
+	keyLock sync.Mutex
+	key     crypto.Signer // the shared leaf key when opts.ReuseKey is set
+
+	inflightLock sync.Mutex
+	inflight     map[string]*generateCall
+}
+
+// generateCall is an in-flight generation that concurrent requests
+// for the same host wait for instead of signing their own certificate.
+type generateCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
 }
 
-// NewCertificate .
-func NewCertificate(cache Cache) *Certificate {
-	return &Certificate{
-		cache: cache,
+// NewCertificate returns a Certificate that signs leaf certificates with ca.
+// A nil ca is allowed, in which case every attempt to generate a certificate fails.
+// A nil opts means the default LeafOptions.
+func NewCertificate(ca *CA, cache Cache, opts *LeafOptions) *Certificate {
+	c := &Certificate{
+		ca:       ca,
+		cache:    cache,
+		inflight: make(map[string]*generateCall),
+	}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.KeyType == "" {
+		c.opts.KeyType = KeyECDSAP256
+	}
+	if c.opts.Backdate <= 0 {
+		c.opts.Backdate = DefaultLeafBackdate
 	}
+	if c.opts.Validity <= 0 {
+		c.opts.Validity = DefaultLeafValidity
+	}
+	if len(c.opts.ExtKeyUsage) == 0 {
+		c.opts.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	return c
+}
+
+// CA returns the CA that signs the leaf certificates, nil if there is none.
+func (c *Certificate) CA() *CA {
+	return c.ca
 }
 
 // GenerateTLSConfig .
@@ -140,78 +190,177 @@ func (c *Certificate) GenerateTLSConfig(host string) (*tls.Config, error) {
 	if h, _, err := net.SplitHostPort(host); err == nil {
 		host = h
 	}
+	cert, err := c.getOrGenerate(host, nil)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+	}
+
+	return tlsConf, nil
+}
+
+// GetCertificate returns the certificate of host, generating it if it is not cached.
+// When upstream is not nil, it is called on a cache miss to fetch the certificate
+// of the origin server, whose names, validity and key usages are then mirrored.
+// upstream may return a nil certificate to fall back to the plain template.
+func (c *Certificate) GetCertificate(host string, upstream func() (*x509.Certificate, error)) (*tls.Certificate, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return c.getOrGenerate(host, upstream)
+}
+
+// getOrGenerate returns the cached certificate of host, or generates one.
+// Only one generation per host runs at a time, other callers share its result.
+func (c *Certificate) getOrGenerate(host string, upstream func() (*x509.Certificate, error)) (*tls.Certificate, error) {
 	if c.cache != nil {
 		if cert := c.cache.Get(host); cert != nil {
-			tlsConf := &tls.Config{
-				Certificates: []tls.Certificate{*cert},
-			}
+			return cert, nil
+		}
+	}
 
-			return tlsConf, nil
+	c.inflightLock.Lock()
+	if call, ok := c.inflight[host]; ok {
+		c.inflightLock.Unlock()
+		<-call.done
+		return call.cert, call.err
+	}
+	// A generation may have been cached and done since the cache was checked.
+	if c.cache != nil {
+		if cert := c.cache.Get(host); cert != nil {
+			c.inflightLock.Unlock()
+			return cert, nil
 		}
 	}
-	serverCert, serverKey, err := c.GeneratePem(host)
-	if err != nil {
-		return nil, err
+	call := &generateCall{done: make(chan struct{})}
+	c.inflight[host] = call
+	c.inflightLock.Unlock()
+
+	var upstreamCert *x509.Certificate
+	if upstream != nil {
+		upstreamCert, call.err = upstream()
 	}
-	cert, err := tls.X509KeyPair(serverCert, serverKey)
-	if err != nil {
-		return nil, err
+	if call.err == nil {
+		call.cert, call.err = c.generate(host, upstreamCert)
 	}
-	tlsConf := &tls.Config{
-		Certificates: []tls.Certificate{cert},
+	if call.err == nil && c.cache != nil {
+		c.cache.Set(host, call.cert)
 	}
 
-	if c.cache != nil {
-		c.cache.Set(host, &cert)
-	}
+	c.inflightLock.Lock()
+	delete(c.inflight, host)
+	c.inflightLock.Unlock()
+	close(call.done)
 
-	return tlsConf, nil
+	return call.cert, call.err
 }
 
 // GeneratePem .
 func (c *Certificate) GeneratePem(host string) (cert []byte, key []byte, err error) {
-	priv, err := rsa.GenerateKey(crand.Reader, 2048)
-	if err != nil {
-		return nil, nil, err
-	}
-	tmpl := c.template(host)
-	derBytes, err := x509.CreateCertificate(crand.Reader, tmpl, rootCA, &priv.PublicKey, rootKey)
+	tlsCert, err := c.generate(host, nil)
 	if err != nil {
 		return nil, nil, err
 	}
 	certBlock := &pem.Block{
 		Type:  "CERTIFICATE",
-		Bytes: derBytes,
+		Bytes: tlsCert.Certificate[0],
 	}
 	serverCert := pem.EncodeToMemory(certBlock)
 
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(tlsCert.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
 	keyBlock := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+		Type:  "PRIVATE KEY",
+		Bytes: keyBytes,
 	}
 	serverKey := pem.EncodeToMemory(keyBlock)
 
 	return serverCert, serverKey, nil
 }
 
-func (c *Certificate) template(host string) *x509.Certificate {
-	bi := big.NewInt(0)
-	h := md5.New()
-	h.Write([]byte(host))
-	hexstr := hex.EncodeToString(h.Sum(nil))
-	bi.SetString(hexstr, 16)
+// generate signs a leaf certificate for host, mirroring upstream if it is not nil.
+func (c *Certificate) generate(host string, upstream *x509.Certificate) (*tls.Certificate, error) {
+	if c.ca == nil {
+		return nil, errNoCA
+	}
+	priv, err := c.leafKey()
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := c.template(host, priv)
+	if err != nil {
+		return nil, err
+	}
+	if upstream != nil {
+		c.mirror(tmpl, host, priv, upstream)
+	}
+	derBytes, err := x509.CreateCertificate(crand.Reader, tmpl, c.ca.Cert, priv.Public(), c.ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{derBytes},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, nil
+}
+
+// leafKey returns the private key of the next leaf certificate.
+func (c *Certificate) leafKey() (crypto.Signer, error) {
+	if !c.opts.ReuseKey {
+		return GenerateKey(c.opts.KeyType)
+	}
+	c.keyLock.Lock()
+	defer c.keyLock.Unlock()
+	if c.key == nil {
+		key, err := GenerateKey(c.opts.KeyType)
+		if err != nil {
+			return nil, err
+		}
+		c.key = key
+	}
+	return c.key, nil
+}
+
+func (c *Certificate) template(host string, priv crypto.Signer) (*x509.Certificate, error) {
+	// Serial numbers have to be unique per CA, or clients like Firefox reject
+	// a renewed certificate of the same host.
+	serial, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(c.opts.Validity)
+	if notAfter.After(c.ca.Cert.NotAfter) {
+		notAfter = c.ca.Cert.NotAfter
+	}
+	keyUsage := c.opts.KeyUsage
+	if keyUsage == 0 {
+		keyUsage = x509.KeyUsageDigitalSignature
+		if _, ok := priv.(*rsa.PrivateKey); ok {
+			keyUsage |= x509.KeyUsageKeyEncipherment
+		}
+	}
 	cert := &x509.Certificate{
-		SerialNumber: bi,
-		// SerialNumber: big.NewInt(1),
+		SerialNumber: serial,
 		Subject: pkix.Name{
-			CommonName: host,
+			CommonName:         host,
+			Organization:       c.opts.Organization,
+			OrganizationalUnit: c.opts.OrganizationalUnit,
 		},
-		NotBefore:             time.Now().AddDate(-1, 0, 0),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
+		NotBefore:             now.Add(-c.opts.Backdate),
+		NotAfter:              notAfter,
 		BasicConstraintsValid: true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		// KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageDataEncipherment,
-		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageDataEncipherment | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           c.opts.ExtKeyUsage,
+		KeyUsage:              keyUsage,
 	}
 
 	if ip := net.ParseIP(host); ip != nil {
@@ -220,23 +369,45 @@ func (c *Certificate) template(host string) *x509.Certificate {
 		cert.DNSNames = []string{host}
 	}
 
-	return cert
+	return cert, nil
 }
 
-// RootCAPem .
-func RootCAPem() []byte {
-	return rootCAPem
-}
+// mirror copies the subject, names, validity and key usages of upstream into tmpl.
+// host is added to the names if upstream does not cover it.
+func (c *Certificate) mirror(tmpl *x509.Certificate, host string, priv crypto.Signer, upstream *x509.Certificate) {
+	tmpl.Subject = upstream.Subject
+	tmpl.DNSNames = upstream.DNSNames
+	tmpl.IPAddresses = upstream.IPAddresses
+	tmpl.URIs = upstream.URIs
+	tmpl.EmailAddresses = upstream.EmailAddresses
+	if upstream.VerifyHostname(host) != nil {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
 
-func loadRootCA() (*x509.Certificate, error) {
-	block, _ := pem.Decode(rootCAPem)
+	tmpl.NotBefore = upstream.NotBefore
+	tmpl.NotAfter = upstream.NotAfter
+	if tmpl.NotAfter.After(c.ca.Cert.NotAfter) {
+		tmpl.NotAfter = c.ca.Cert.NotAfter
+	}
 
-	return x509.ParseCertificate(block.Bytes)
+	if upstream.KeyUsage != 0 {
+		tmpl.KeyUsage = upstream.KeyUsage
+		// Only RSA keys can encipher keys, the leaf key may be of another type than upstream's.
+		if _, ok := priv.(*rsa.PrivateKey); !ok {
+			tmpl.KeyUsage &^= x509.KeyUsageKeyEncipherment
+			tmpl.KeyUsage |= x509.KeyUsageDigitalSignature
+		}
+	}
+	if len(upstream.ExtKeyUsage) != 0 {
+		tmpl.ExtKeyUsage = upstream.ExtKeyUsage
+	}
 }
 
-// loadRootKey loads root private key.
-func loadRootKey() (*rsa.PrivateKey, error) {
-	block, _ := pem.Decode(rootKeyPem)
-
-	return x509.ParsePKCS1PrivateKey(block.Bytes)
+// RootCAPem returns the built-in root CA in PEM format.
+func RootCAPem() []byte {
+	return rootCAPem
 }
@@ -0,0 +1,176 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DirCache is a Cache backed by a directory of PEM files, one per host,
+// so that generated certificates survive restarts.
+// Files are replaced atomically and guarded by a single lock file, dir/.lock,
+// which lets several processes share one directory. Certificates that were not
+// signed by the current CA, or that are about to expire, are ignored.
+type DirCache struct {
+	dir         string
+	ca          *CA
+	renewBefore time.Duration
+	mem         Cache
+}
+
+var _ Cache = &DirCache{}
+
+// NewDirCache creates dir if needed and returns a DirCache for certificates signed by ca.
+// mem is an optional in-memory Cache that is consulted before the directory.
+func NewDirCache(dir string, ca *CA, renewBefore time.Duration, mem Cache) (*DirCache, error) {
+	if ca == nil {
+		return nil, errNoCA
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirCache{
+		dir:         dir,
+		ca:          ca,
+		renewBefore: renewBefore,
+		mem:         mem,
+	}, nil
+}
+
+// Get returns the certificate of host from memory or from the directory.
+func (c *DirCache) Get(host string) *tls.Certificate {
+	if c.mem != nil {
+		if cert := c.mem.Get(host); cert != nil {
+			return cert
+		}
+	}
+	cert, err := c.load(host)
+	if err != nil {
+		return nil
+	}
+	if c.mem != nil {
+		c.mem.Set(host, cert)
+	}
+	return cert
+}
+
+// Set stores the certificate of host in memory and in the directory.
+func (c *DirCache) Set(host string, cert *tls.Certificate) {
+	if c.mem != nil {
+		c.mem.Set(host, cert)
+	}
+	if err := c.store(host, cert); err != nil {
+		logger.Warningf("Store certificate of %s in %s failed: %s", host, c.dir, err)
+	}
+}
+
+func (c *DirCache) load(host string) (*tls.Certificate, error) {
+	name := c.path(host)
+	unlock, err := lockFile(c.lockPath(), false)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(name)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var certPEM, keyPEM []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		} else {
+			keyPEM = pem.EncodeToMemory(block)
+		}
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := leaf.CheckSignatureFrom(c.ca.Cert); err != nil {
+		return nil, fmt.Errorf("%s is not signed by the current CA: %s", name, err)
+	}
+	if time.Now().Add(c.renewBefore).After(leaf.NotAfter) {
+		return nil, errors.New(name + " is about to expire")
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+func (c *DirCache) store(host string, cert *tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("empty certificate")
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, der := range cert.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+
+	name := c.path(host)
+	unlock, err := lockFile(c.lockPath(), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Write to a temporary file in the same directory and rename it,
+	// so that readers never see a partially written file.
+	tmp, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// path maps host to a file name, escaping everything but [a-z0-9.-].
+func (c *DirCache) path(host string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(host) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			b.WriteRune(r)
+		} else {
+			fmt.Fprintf(&b, "_%06x", r)
+		}
+	}
+	return filepath.Join(c.dir, b.String()+".pem")
+}
+
+// lockPath is the lock file of the whole directory. A lock file per host
+// could not be removed safely, and they would pile up.
+func (c *DirCache) lockPath() string {
+	return filepath.Join(c.dir, ".lock")
+}
@@ -0,0 +1,133 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Key types supported when generating CA and leaf keys.
+const (
+	KeyRSA2048   = "rsa2048"
+	KeyRSA4096   = "rsa4096"
+	KeyECDSAP256 = "ecdsa-p256"
+	KeyECDSAP384 = "ecdsa-p384"
+	KeyEd25519   = "ed25519"
+)
+
+// GenerateKey generates a private key of the given type.
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyRSA2048:
+		return rsa.GenerateKey(crand.Reader, 2048)
+	case KeyRSA4096:
+		return rsa.GenerateKey(crand.Reader, 4096)
+	case KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), crand.Reader)
+	case KeyEd25519:
+		_, priv, err := ed25519.GenerateKey(crand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("unsupported key type %q", keyType)
+}
+
+// CAOptions describes the root CA created by GenerateCA.
+type CAOptions struct {
+	Subject  pkix.Name
+	KeyType  string
+	Validity time.Duration
+}
+
+// GenerateCA creates a new self-signed root CA.
+func GenerateCA(opts *CAOptions) (*CA, error) {
+	if opts.Subject.CommonName == "" {
+		return nil, errors.New("CA common name is empty")
+	}
+	if opts.Validity <= 0 {
+		return nil, errors.New("CA validity must be positive")
+	}
+	key, err := GenerateKey(opts.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	ski := sha1.Sum(spki)
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               opts.Subject,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(opts.Validity),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		SubjectKeyId:          ski[:],
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return NewCA(cert, key)
+}
+
+// CertPEM returns the CA certificate in PEM format.
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw})
+}
+
+// KeyPEM returns the CA private key in PKCS#8 PEM format.
+func (ca *CA) KeyPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Fingerprint returns the colon separated hex digest of the DER encoded certificate.
+// Supported algorithms are "sha1" and "sha256".
+func Fingerprint(cert *x509.Certificate, algorithm string) (string, error) {
+	var sum []byte
+	switch algorithm {
+	case "sha1":
+		s := sha1.Sum(cert.Raw)
+		sum = s[:]
+	case "sha256":
+		s := sha256.Sum256(cert.Raw)
+		sum = s[:]
+	default:
+		return "", fmt.Errorf("unsupported fingerprint algorithm %q", algorithm)
+	}
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":"), nil
+}
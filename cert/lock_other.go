@@ -0,0 +1,10 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package cert
+
+// lockFile is a no-op where flock is not available,
+// DirCache then only relies on atomic renames.
+func lockFile(name string, exclusive bool) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,6 @@
+package cert
+
+import "github.com/op/go-logging"
+
+// logger has the module of proxychannel.Logger, hence its level and format.
+var logger = logging.MustGetLogger("ProxyChannel")
@@ -0,0 +1,147 @@
+package cert
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+// Defaults of the LRUCache proxychannel.NewProxy creates when none is configured.
+const (
+	DefaultCacheCapacity    = 1024
+	DefaultCacheTTL         = 24 * time.Hour
+	DefaultCacheRenewBefore = time.Hour
+)
+
+// CacheStats counts what happened to an LRUCache.
+type CacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64 // entries dropped because the cache is full
+	Expirations uint64 // entries dropped because of TTL or upcoming NotAfter
+}
+
+// LRUCache is a Cache that holds at most capacity certificates.
+// The least recently used certificate is evicted when the cache is full,
+// and a certificate is dropped after ttl or renewBefore its NotAfter,
+// whichever comes first, so that a fresh one gets generated.
+type LRUCache struct {
+	capacity    int
+	ttl         time.Duration
+	renewBefore time.Duration
+
+	lock  sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	stats CacheStats
+}
+
+type lruEntry struct {
+	host   string
+	cert   *tls.Certificate
+	expire time.Time
+}
+
+var _ Cache = &LRUCache{}
+
+// NewLRUCache creates an LRUCache.
+// A capacity <= 0 means no limit and a ttl <= 0 means no TTL.
+func NewLRUCache(capacity int, ttl, renewBefore time.Duration) *LRUCache {
+	return &LRUCache{
+		capacity:    capacity,
+		ttl:         ttl,
+		renewBefore: renewBefore,
+		ll:          list.New(),
+		items:       make(map[string]*list.Element),
+	}
+}
+
+// Get returns the certificate of host, or nil if it is missing or about to expire.
+func (c *LRUCache) Get(host string) *tls.Certificate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[host]
+	if !ok {
+		c.stats.Misses++
+		return nil
+	}
+	entry := e.Value.(*lruEntry)
+	if !entry.expire.IsZero() && !time.Now().Before(entry.expire) {
+		c.removeElement(e)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return nil
+	}
+	c.ll.MoveToFront(e)
+	c.stats.Hits++
+	return entry.cert
+}
+
+// Set stores the certificate of host, evicting the least recently used one if needed.
+func (c *LRUCache) Set(host string, cert *tls.Certificate) {
+	expire := c.expireTime(cert)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[host]; ok {
+		entry := e.Value.(*lruEntry)
+		entry.cert = cert
+		entry.expire = expire
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[host] = c.ll.PushFront(&lruEntry{host: host, cert: cert, expire: expire})
+	for c.capacity > 0 && c.ll.Len() > c.capacity {
+		c.removeElement(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Remove drops the certificate of host.
+func (c *LRUCache) Remove(host string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[host]; ok {
+		c.removeElement(e)
+	}
+}
+
+// Len returns the number of cached certificates.
+func (c *LRUCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ll.Len()
+}
+
+// Stats returns a snapshot of the counters.
+func (c *LRUCache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+func (c *LRUCache) removeElement(e *list.Element) {
+	c.ll.Remove(e)
+	delete(c.items, e.Value.(*lruEntry).host)
+}
+
+// expireTime returns when cert should no longer be served from the cache,
+// the zero time means never.
+func (c *LRUCache) expireTime(cert *tls.Certificate) time.Time {
+	var expire time.Time
+	if c.ttl > 0 {
+		expire = time.Now().Add(c.ttl)
+	}
+	leaf := cert.Leaf
+	if leaf == nil && len(cert.Certificate) > 0 {
+		leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if leaf != nil {
+		renew := leaf.NotAfter.Add(-c.renewBefore)
+		if expire.IsZero() || renew.Before(expire) {
+			expire = renew
+		}
+	}
+	return expire
+}
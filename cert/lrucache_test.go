@@ -0,0 +1,80 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func certExpiringIn(d time.Duration) *tls.Certificate {
+	return &tls.Certificate{Leaf: &x509.Certificate{NotAfter: time.Now().Add(d)}}
+}
+
+func TestLRUCacheExpiration(t *testing.T) {
+	tests := []struct {
+		name        string
+		ttl         time.Duration
+		renewBefore time.Duration
+		cert        *tls.Certificate
+		wait        time.Duration
+		hit         bool
+	}{
+		{"no ttl, no leaf", 0, 0, &tls.Certificate{}, 0, true},
+		{"valid", time.Hour, time.Hour, certExpiringIn(24 * time.Hour), 0, true},
+		{"renewal due", time.Hour, time.Hour, certExpiringIn(30 * time.Minute), 0, false},
+		{"renewal before ttl", time.Hour, time.Hour, certExpiringIn(time.Hour + 20*time.Millisecond), 50 * time.Millisecond, false},
+		{"expired", 0, 0, certExpiringIn(-time.Minute), 0, false},
+		{"ttl elapsed", 20 * time.Millisecond, 0, certExpiringIn(24 * time.Hour), 50 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewLRUCache(0, tt.ttl, tt.renewBefore)
+			c.Set("example.com", tt.cert)
+			time.Sleep(tt.wait)
+			got := c.Get("example.com")
+			if hit := got != nil; hit != tt.hit {
+				t.Fatalf("Get hit = %v, want %v", hit, tt.hit)
+			}
+			stats := c.Stats()
+			if tt.hit {
+				if stats.Hits != 1 || stats.Expirations != 0 || c.Len() != 1 {
+					t.Errorf("stats = %+v, len %d", stats, c.Len())
+				}
+			} else if stats.Misses != 1 || stats.Expirations != 1 || c.Len() != 0 {
+				t.Errorf("stats = %+v, len %d", stats, c.Len())
+			}
+		})
+	}
+}
+
+func TestLRUCacheRenewal(t *testing.T) {
+	c := NewLRUCache(0, time.Hour, time.Hour)
+	c.Set("example.com", certExpiringIn(30*time.Minute))
+	if c.Get("example.com") != nil {
+		t.Fatal("certificate due for renewal was served")
+	}
+	renewed := certExpiringIn(24 * time.Hour)
+	c.Set("example.com", renewed)
+	if got := c.Get("example.com"); got != renewed {
+		t.Fatalf("Get = %v, want the renewed certificate", got)
+	}
+}
+
+func TestLRUCacheEviction(t *testing.T) {
+	c := NewLRUCache(2, 0, 0)
+	a, b, d := &tls.Certificate{}, &tls.Certificate{}, &tls.Certificate{}
+	c.Set("a", a)
+	c.Set("b", b)
+	c.Get("a")
+	c.Set("d", d)
+	if c.Get("b") != nil {
+		t.Error("least recently used certificate was not evicted")
+	}
+	if c.Get("a") != a || c.Get("d") != d {
+		t.Error("recently used certificates were evicted")
+	}
+	if stats := c.Stats(); stats.Evictions != 1 {
+		t.Errorf("Evictions = %d, want 1", stats.Evictions)
+	}
+}
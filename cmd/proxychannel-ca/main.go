@@ -0,0 +1,216 @@
+// Command proxychannel-ca creates, inspects and exports the root CA
+// that proxychannel uses to sign MITM certificates.
+//
+// Usage:
+//
+//	proxychannel-ca create  -cn "My MITM CA" -key ecdsa-p256 -days 3650 -cert ca.crt -keyout ca.key
+//	proxychannel-ca inspect -cert ca.crt
+//	proxychannel-ca export  -cert ca.crt -format der -out ca.der
+//	proxychannel-ca export  -cert ca.crt -key ca.key -format p12 -password secret -out ca.p12
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/spritesprite/proxychannel/cert"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <create|inspect|export> [flags]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Run \"%s <command> -h\" for the flags of each command.\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "create":
+		err = create(os.Args[2:])
+	case "inspect":
+		err = inspect(os.Args[2:])
+	case "export":
+		err = export(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %s\n", os.Args[0], os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func create(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	cn := fs.String("cn", "proxychannel MITM CA", "subject common name")
+	org := fs.String("o", "", "subject organization")
+	ou := fs.String("ou", "", "subject organizational unit")
+	country := fs.String("c", "", "subject country")
+	keyType := fs.String("key", cert.KeyECDSAP256, "key type: rsa2048, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519")
+	days := fs.Int("days", 3650, "validity in days")
+	certOut := fs.String("cert", "ca.crt", "output file of the PEM encoded certificate")
+	keyOut := fs.String("keyout", "ca.key", "output file of the PEM encoded private key")
+	force := fs.Bool("f", false, "overwrite existing files")
+	fs.Parse(args)
+
+	if !*force {
+		for _, name := range []string{*certOut, *keyOut} {
+			if _, err := os.Stat(name); err == nil {
+				return fmt.Errorf("%s already exists, use -f to overwrite it", name)
+			}
+		}
+	}
+
+	subject := pkix.Name{CommonName: *cn}
+	if *org != "" {
+		subject.Organization = []string{*org}
+	}
+	if *ou != "" {
+		subject.OrganizationalUnit = []string{*ou}
+	}
+	if *country != "" {
+		subject.Country = []string{*country}
+	}
+	ca, err := cert.GenerateCA(&cert.CAOptions{
+		Subject:  subject,
+		KeyType:  *keyType,
+		Validity: time.Duration(*days) * 24 * time.Hour,
+	})
+	if err != nil {
+		return err
+	}
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*keyOut, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*certOut, ca.CertPEM(), 0644); err != nil {
+		return err
+	}
+	return printInfo(ca.Cert)
+}
+
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	certFile := fs.String("cert", "ca.crt", "PEM or DER encoded certificate")
+	fs.Parse(args)
+
+	c, err := readCert(*certFile)
+	if err != nil {
+		return err
+	}
+	return printInfo(c)
+}
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	certFile := fs.String("cert", "ca.crt", "PEM or DER encoded certificate")
+	keyFile := fs.String("key", "", "PEM encoded private key, only used by the p12 format")
+	format := fs.String("format", "pem", "output format: pem, der or p12")
+	password := fs.String("password", "", "password of the p12 file")
+	legacy := fs.Bool("legacy", false, "use legacy p12 algorithms for old trust stores")
+	out := fs.String("out", "", "output file, stdout if empty")
+	fs.Parse(args)
+
+	c, err := readCert(*certFile)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	switch *format {
+	case "pem":
+		data = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	case "der":
+		data = c.Raw
+	case "p12":
+		enc := pkcs12.Modern
+		if *legacy {
+			enc = pkcs12.Legacy
+		}
+		if *keyFile == "" {
+			// A trust store only holds the certificate, which is what browsers import.
+			data, err = enc.EncodeTrustStore([]*x509.Certificate{c}, *password)
+		} else {
+			var ca *cert.CA
+			ca, err = cert.LoadCA(*certFile, *keyFile)
+			if err != nil {
+				return err
+			}
+			data, err = enc.Encode(ca.Key, ca.Cert, nil, *password)
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported format %q", *format)
+	}
+
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	mode := os.FileMode(0644)
+	if *keyFile != "" {
+		mode = 0600
+	}
+	return ioutil.WriteFile(*out, data, mode)
+}
+
+func readCert(name string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("%s: unexpected PEM block type %q", name, block.Type)
+		}
+		data = block.Bytes
+	}
+	c, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	if !c.IsCA {
+		return nil, errors.New(name + ": certificate is not a CA")
+	}
+	return c, nil
+}
+
+func printInfo(c *x509.Certificate) error {
+	sha1FP, err := cert.Fingerprint(c, "sha1")
+	if err != nil {
+		return err
+	}
+	sha256FP, err := cert.Fingerprint(c, "sha256")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Subject:       %s\n", c.Subject)
+	fmt.Printf("Issuer:        %s\n", c.Issuer)
+	fmt.Printf("Serial:        %X\n", c.SerialNumber)
+	fmt.Printf("Key:           %s\n", c.PublicKeyAlgorithm)
+	fmt.Printf("Not Before:    %s\n", c.NotBefore.UTC().Format(time.RFC3339))
+	fmt.Printf("Not After:     %s\n", c.NotAfter.UTC().Format(time.RFC3339))
+	fmt.Printf("SHA-1:         %s\n", sha1FP)
+	fmt.Printf("SHA-256:       %s\n", sha256FP)
+	return nil
+}
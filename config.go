@@ -1,7 +1,10 @@
 package proxychannel
 
 import (
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
+	"io"
 	"net"
 	"net/http"
 	"sync"
@@ -11,6 +14,8 @@ import (
 )
 
 // Cache is a concurrent map.
+//
+// Deprecated: it is unbounded, use cert.LRUCache.
 type Cache struct {
 	m sync.Map
 }
@@ -32,14 +37,12 @@ func (c *Cache) Get(host string) *tls.Certificate {
 
 // DefaultHandlerConfig .
 var DefaultHandlerConfig *HandlerConfig = &HandlerConfig{
-	DisableKeepAlive: false,
-	Delegate:         &DefaultDelegate{},
-	DecryptHTTPS:     false,
-	CertCache:        &Cache{},
+	DisableKeepAlive:     false,
+	Delegate:             &DefaultDelegate{},
+	DecryptHTTPS:         false,
+	MITMFailureThreshold: 3,
+	MITMBypassTTL:        time.Hour,
 	Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
 		DialContext: (&net.Dialer{
 			// Timeout:   30 * time.Second,
 			// KeepAlive: 30 * time.Second,
@@ -64,9 +67,123 @@ type HandlerConfig struct {
 	DisableKeepAlive bool
 	Delegate         Delegate
 	DecryptHTTPS     bool
-	CertCache        cert.Cache
 	Transport        *http.Transport
 	Mode             int
+
+	// CertCache holds the MITM certificates, keyed by host only, so it must not
+	// be shared by proxies with different CAs. nil means a new LRUCache
+	// with the default capacity, TTL and renewal.
+	CertCache cert.Cache
+
+	// The root CA used to sign MITM certificates, either loaded from
+	// PEM files or given as a certificate and its private key.
+	// UseBuiltinCA falls back to the publicly known CA shipped in package cert,
+	// which should only be used for demos.
+	CACertFile   string
+	CAKeyFile    string
+	CACert       *x509.Certificate
+	CAKey        crypto.Signer
+	UseBuiltinCA bool
+
+	// LeafOptions controls the key type, key reuse, validity and template
+	// fields of the generated MITM certificates. Nil means the defaults.
+	LeafOptions *cert.LeafOptions
+
+	// CertCacheDir persists generated certificates in a directory that
+	// can be shared by several processes, with CertCache kept in front of it.
+	CertCacheDir string
+
+	// MirrorUpstreamCert makes MITM certificates copy the names, validity and
+	// key usages of the origin's certificate, which is fetched by dialing the
+	// CONNECT authority with the SNI the client sent, through the parent proxies
+	// the Delegate returns for the CONNECT.
+	MirrorUpstreamCert bool
+
+	// MITMIdleTimeout closes a MITM'd connection that has not sent
+	// another request for this long, 30 seconds by default.
+	MITMIdleTimeout time.Duration
+
+	// DisableMITMHTTP2 stops offering h2 to clients of MITM'd connections,
+	// which then only speak HTTP/1.1.
+	DisableMITMHTTP2 bool
+
+	// MITMHosts limits DecryptHTTPS to the matching hosts, the rest is tunneled.
+	// MITMExcludeHosts are never decrypted. Host patterns are case-insensitive and
+	// ignore the port: "example.com" only matches example.com, "*.example.com" its
+	// subdomains, ".example.com" both, and "*" every host.
+	MITMHosts        []string
+	MITMExcludeHosts []string
+
+	// After MITMFailureThreshold client handshakes in a row rejected the MITM
+	// certificate, each within MITMBypassTTL of the previous one, e.g. because
+	// the client pins certificates, a host is tunneled for MITMBypassTTL.
+	// Zero disables the fallback.
+	MITMFailureThreshold int
+	MITMBypassTTL        time.Duration
+
+	// Origin certificates are verified against the system pool, or
+	// Transport.TLSClientConfig.RootCAs if set, plus the PEM bundles in UpstreamCAFiles.
+	// UpstreamInsecureHosts are not verified. Setting InsecureSkipVerify
+	// on Transport.TLSClientConfig disables verification altogether.
+	UpstreamCAFiles       []string
+	UpstreamInsecureHosts []string
+
+	// UpstreamClientCerts maps host patterns to the client certificate presented
+	// to the origins that ask for one, the longest matching pattern wins.
+	UpstreamClientCerts map[string]*tls.Certificate
+
+	// KeyLogWriter receives the TLS session keys of both legs of MITM'd
+	// connections. Use a KeyLogWriter to rotate the file and toggle it at runtime.
+	KeyLogWriter io.Writer
+
+	// ParentProxyTLSConfig holds the CAs and client certificates used with
+	// https:// parent proxies, nil means the trust store of origins.
+	// The SNI is the host of the parent, unless ParentProxyServerNames maps
+	// its host:port to another name or ParentProxyTLSConfig.ServerName is set.
+	ParentProxyTLSConfig   *tls.Config
+	ParentProxyServerNames map[string]string
+
+	// SOCKS5RequireAuth makes SOCKS5 clients authenticate with a username and
+	// password, which Delegate.Auth finds in the Proxy-Authorization of ctx.Req.
+	SOCKS5RequireAuth bool
+
+	// SOCKS5UDPIdleTimeout ends a SOCKS5 UDP ASSOCIATE that has not relayed
+	// a datagram for this long, 2 minutes by default.
+	SOCKS5UDPIdleTimeout time.Duration
+
+	// ServePAC answers GET /proxy.pac and /wpad.dat sent to the proxy itself with
+	// a PAC file sending clients to PACProxyAddrs, except for the PACBypass hosts.
+	// PACProxyAddrs are host:port or https:// and socks5:// URLs, ServerConfig.ProxyAddr
+	// by default, and a missing host is the one the PAC file was fetched from.
+	// PACBypass holds hosts like "example.com", "*.example.com" for the subdomains,
+	// ".example.com" for both, IPv4 CIDRs and "<local>" for plain host names.
+	ServePAC      bool
+	PACProxyAddrs []string
+	PACBypass     []string
+
+	// ProxyProtocolTrustedCIDRs lists the CIDRs and IPs of the load balancers whose
+	// connections start with a PROXY protocol v1 or v2 header, see ProxyProtocolListener.
+	ProxyProtocolTrustedCIDRs []string
+
+	// SendProxyProtocol maps the host:port of parent proxies and origins to the
+	// PROXY protocol version, 1 or 2, of the header sent to them first, which
+	// holds the client address. It covers tunnels and connections from a ConnPool,
+	// not the requests of the http.Transport of plain HTTP and MITM'd traffic.
+	SendProxyProtocol map[string]int
+}
+
+// LoadCA returns the root CA configured in hconf, or nil if there is none.
+func (hconf *HandlerConfig) LoadCA() (*cert.CA, error) {
+	switch {
+	case hconf.CACertFile != "" || hconf.CAKeyFile != "":
+		return cert.LoadCA(hconf.CACertFile, hconf.CAKeyFile)
+	case hconf.CACert != nil || hconf.CAKey != nil:
+		return cert.NewCA(hconf.CACert, hconf.CAKey)
+	case hconf.UseBuiltinCA:
+		Logger.Warning("Using the built-in MITM root CA, its private key is publicly known!")
+		return cert.BuiltinCA()
+	}
+	return nil, nil
 }
 
 // ServerConfig .
@@ -75,6 +192,15 @@ type ServerConfig struct {
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	TLSConfig    *tls.Config
+
+	// SOCKS5Addr is the address of the SOCKS5 listener, none if empty.
+	SOCKS5Addr string
+
+	// TransparentAddr is the address of the listener for connections redirected
+	// by iptables, none if empty, Linux only. TransparentTPROXY makes it accept
+	// those of the TPROXY target rather than REDIRECT.
+	TransparentAddr   string
+	TransparentTPROXY bool
 }
 
 // LogConfig .
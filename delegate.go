@@ -1,6 +1,7 @@
 package proxychannel
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -16,6 +17,7 @@ type Context struct {
 	Req        *http.Request
 	Data       map[interface{}]interface{}
 	abort      bool
+	certSent   bool // the MITM certificate was handed to the client handshake
 	Hijack     bool
 	MITM       bool
 	ReqLength  int64
@@ -24,6 +26,51 @@ type Context struct {
 	Err        error
 	Closed     bool
 	Lock       sync.RWMutex
+
+	// ClientHello is set during the client handshake of a MITM'd CONNECT.
+	ClientHello *ClientHello
+	// Parent is the Context of the CONNECT that a MITM'd request was read from.
+	// Connect and Auth run once for the parent, the other methods of Delegate
+	// run for every request, and so does Finish before the parent's.
+	Parent *Context
+
+	// ParentProxies is the parent proxy chain the request is sent through.
+	ParentProxies []*url.URL
+	// FailedHop is the 1-based index in ParentProxies of the hop that failed, 0 if none did.
+	FailedHop int
+	// ParentProxyFallbacks may be set by ParentProxy: the parent proxies tried in
+	// order when ParentProxies cannot be connected to, a nil URL meaning direct.
+	// FailedParentProxies are the ones that could not be connected to.
+	ParentProxyFallbacks []*url.URL
+	FailedParentProxies  []*url.URL
+
+	// ClientAddr is the address of the client, which is also in Req.RemoteAddr.
+	// Behind a load balancer sending PROXY protocol headers, it is the one of the
+	// header, and PeerAddr is the address of the load balancer. Otherwise they are equal.
+	ClientAddr net.Addr
+	PeerAddr   net.Addr
+}
+
+// ClientHello stores what the client offered in its TLS ClientHello.
+type ClientHello struct {
+	ServerName        string   // SNI
+	SupportedProtos   []string // ALPN
+	CipherSuites      []uint16
+	SupportedVersions []uint16
+}
+
+// newChildContext returns the Context of a request read from the connection of parent.
+func newChildContext(parent *Context, req *http.Request) *Context {
+	return &Context{
+		Req:         req,
+		Data:        make(map[interface{}]interface{}),
+		Hijack:      parent.Hijack,
+		MITM:        parent.MITM,
+		ClientHello: parent.ClientHello,
+		Parent:      parent,
+		ClientAddr:  parent.ClientAddr,
+		PeerAddr:    parent.PeerAddr,
+	}
 }
 
 // Delegate defines some extra manipulation on requests set by user.
@@ -32,9 +79,12 @@ type Delegate interface {
 	SetExtensionManager(*ExtensionManager)
 	Connect(ctx *Context, rw http.ResponseWriter)
 	Auth(ctx *Context, rw http.ResponseWriter)
+	ShouldMITM(ctx *Context) bool
 	BeforeRequest(ctx *Context)
 	BeforeResponse(ctx *Context, i interface{})
 	ParentProxy(ctx *Context, i interface{}) (*url.URL, error)
+	ParentProxyChain(ctx *Context, i interface{}) ([]*url.URL, error)
+	AllowUDP(ctx *Context, addr string) bool
 	DuringResponse(ctx *Context, i interface{})
 	Finish(ctx *Context, rw http.ResponseWriter)
 	GetConnPool(ctx *Context) ([]randutil.Choice, error)
@@ -61,6 +111,13 @@ func (h *DefaultDelegate) Connect(ctx *Context, rw http.ResponseWriter) {}
 // Auth .
 func (h *DefaultDelegate) Auth(ctx *Context, rw http.ResponseWriter) {}
 
+// ShouldMITM decides whether a CONNECT is decrypted or tunneled.
+// ctx.MITM holds the decision made from DecryptHTTPS, MITMHosts, MITMExcludeHosts
+// and the legacy "MITM: Enabled" header, which is what the default returns.
+func (h *DefaultDelegate) ShouldMITM(ctx *Context) bool {
+	return ctx.MITM
+}
+
 // BeforeRequest .
 func (h *DefaultDelegate) BeforeRequest(ctx *Context) {}
 
@@ -72,6 +129,20 @@ func (h *DefaultDelegate) ParentProxy(ctx *Context, i interface{}) (*url.URL, er
 	return http.ProxyFromEnvironment(ctx.Req)
 }
 
+// ParentProxyChain returns the parent proxies a request is sent through, in order.
+// The proxy connects to the first one and tunnels through each of them to the next.
+// ParentProxy is used instead when it returns no proxies, which is what the default does.
+func (h *DefaultDelegate) ParentProxyChain(ctx *Context, i interface{}) ([]*url.URL, error) {
+	return nil, nil
+}
+
+// AllowUDP decides whether the datagrams of a SOCKS5 UDP ASSOCIATE may be
+// relayed to addr, the host:port the client sent them to. It is asked once
+// per destination of an association, the default allows all of them.
+func (h *DefaultDelegate) AllowUDP(ctx *Context, addr string) bool {
+	return true
+}
+
 // DuringResponse .
 func (h *DefaultDelegate) DuringResponse(ctx *Context, i interface{}) {}
 
@@ -99,6 +170,10 @@ func (c *Context) SetContextErrorWithType(err error, errType string) {
 	}
 	c.ErrType = errType
 	c.Err = err
+	var hopErr *ParentProxyError
+	if errors.As(err, &hopErr) {
+		c.FailedHop = hopErr.Hop
+	}
 }
 
 // SetPoolContextErrorWithType .
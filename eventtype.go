@@ -24,6 +24,16 @@ const (
 	TunnelConnectRemoteFail         = "TUNNEL_CONNECT_REMOTE_FAIL"
 	TunnelWriteTargetConnFinish     = "TUNNEL_WRITE_TARGET_CONN_FINISH"
 	TunnelWriteClientConnFinish     = "TUNNEL_WRITE_CLIENT_CONN_FINISH"
+	UpstreamCertVerifyFail          = "UPSTREAM_CERT_VERIFY_FAIL"
+	UpstreamClientCertFail          = "UPSTREAM_CLIENT_CERT_FAIL"
+	SOCKS5HandshakeFail             = "SOCKS5_HANDSHAKE_FAIL"
+	SOCKS5AuthFail                  = "SOCKS5_AUTH_FAIL"
+	SOCKS5ConnectFail               = "SOCKS5_CONNECT_FAIL"
+	ParentProxyHopFail              = "PARENT_PROXY_HOP_FAIL"
+	SOCKS5UDPListenFail             = "SOCKS5_UDP_LISTEN_FAIL"
+	SOCKS5UDPRelayFail              = "SOCKS5_UDP_RELAY_FAIL"
+	SOCKS5UDPIdleTimeout            = "SOCKS5_UDP_IDLE_TIMEOUT"
+	ProxyProtocolFail               = "PROXY_PROTOCOL_FAIL"
 
 	PoolGetParentProxyFail         = "POOL_GET_PARENT_PROXY_FAIL"
 	PoolReadRemoteFail             = "POOL_READ_REMOTE_FAIL"
@@ -7,8 +7,12 @@ import (
 func main() {
 	// Providing certain log configuration before Run() is optional
 	// e.g. ConfigLogging(lconf) where lconf is a *LogConfig
+	hconf := *proxychannel.DefaultHandlerConfig
+	// The built-in CA is publicly known, use your own one with
+	// CACertFile and CAKeyFile outside of demos.
+	hconf.UseBuiltinCA = true
 	pc := proxychannel.NewProxychannel(
-		proxychannel.DefaultHandlerConfig,
+		&hconf,
 		proxychannel.DefaultServerConfig,
 		make(map[string]proxychannel.Extension))
 	pc.Run()
@@ -1,10 +1,21 @@
 module github.com/spritesprite/proxychannel
 
-go 1.13
+go 1.17
 
 require (
+	github.com/dop251/goja v0.0.0-20230806174421-c933cf95e127
 	github.com/jmcvetta/randutil v0.0.0-20150817122601-2bb1b664bcff
 	github.com/mroth/weightedrand v0.4.1
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	github.com/stretchr/testify v1.6.1 // indirect
+	golang.org/x/net v0.11.0
+	golang.org/x/text v0.13.0 // indirect
+	software.sslmate.com/src/go-pkcs12 v0.4.0
+)
+
+require (
+	github.com/dlclark/regexp2 v1.7.0 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
+	golang.org/x/crypto v0.11.0 // indirect
 )
@@ -0,0 +1,43 @@
+package proxychannel
+
+import (
+	"net"
+	"strings"
+)
+
+// matchHostPattern checks whether host, with or without a port, matches pattern:
+//
+//	"*"             matches every host
+//	"*.example.com" matches the subdomains of example.com
+//	".example.com"  matches example.com and its subdomains
+//	"example.com"   only matches example.com
+//
+// Matching is case-insensitive.
+func matchHostPattern(pattern string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	switch {
+	case pattern == "":
+		return false
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	case strings.HasPrefix(pattern, "."):
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	}
+	return host == pattern
+}
+
+// matchHostPatterns checks whether host matches any of patterns.
+func matchHostPatterns(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package proxychannel
+
+import "testing"
+
+func TestMatchHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"", "example.com", false},
+		{"*", "example.com", true},
+		{"*", "127.0.0.1:8080", true},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+		{".example.com", "example.com", true},
+		{".example.com", "www.example.com", true},
+		{".example.com", "badexample.com", false},
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"example.com", "example.com:443", true},
+		{"example.com", "EXAMPLE.com.", true},
+		{" Example.COM ", "example.com", true},
+		{"::1", "[::1]:443", true},
+		{"10.0.0.1", "10.0.0.10", false},
+	}
+	for _, tt := range tests {
+		if got := matchHostPattern(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("matchHostPattern(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestMatchHostPatterns(t *testing.T) {
+	patterns := []string{"*.example.com", "example.org"}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"www.example.com", true},
+		{"example.org:80", true},
+		{"example.net", false},
+	}
+	for _, tt := range tests {
+		if got := matchHostPatterns(patterns, tt.host); got != tt.want {
+			t.Errorf("matchHostPatterns(%q, %q) = %v, want %v", patterns, tt.host, got, tt.want)
+		}
+	}
+	if matchHostPatterns(nil, "example.com") {
+		t.Error("no pattern matched a host")
+	}
+}
@@ -0,0 +1,149 @@
+package proxychannel
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// KeyLogWriter writes TLS session keys in the NSS key log format, the one
+// of SSLKEYLOGFILE, which lets Wireshark decrypt captured traffic.
+// Set it as HandlerConfig.KeyLogWriter to log both legs of MITM'd connections.
+//
+// The file is opened on the first write and rotated once it grows beyond
+// maxSize, keeping maxBackups old files named path.1, path.2 and so on.
+// Lines are never split between files. Logging can be turned off and on
+// at runtime, and nothing is written while it is off.
+type KeyLogWriter struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	enabled    int32
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewKeyLogWriter creates an enabled KeyLogWriter.
+// A maxSize <= 0 means the file is only rotated by calling Rotate.
+func NewKeyLogWriter(path string, maxSize int64, maxBackups int) *KeyLogWriter {
+	return &KeyLogWriter{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		enabled:    1,
+	}
+}
+
+// Enable turns key logging on.
+func (w *KeyLogWriter) Enable() {
+	atomic.StoreInt32(&w.enabled, 1)
+}
+
+// Disable turns key logging off and closes the file.
+func (w *KeyLogWriter) Disable() {
+	atomic.StoreInt32(&w.enabled, 0)
+	w.Close()
+}
+
+// Enabled checks whether key logging is on.
+func (w *KeyLogWriter) Enabled() bool {
+	return atomic.LoadInt32(&w.enabled) == 1
+}
+
+// Write appends a key log line, crypto/tls writes one line per call.
+func (w *KeyLogWriter) Write(p []byte) (int, error) {
+	if !w.Enabled() {
+		return len(p), nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.Enabled() {
+		// Disabled while waiting for the lock.
+		return len(p), nil
+	}
+	if w.file != nil && w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			Logger.Errorf("KeyLogWriter rotate %s failed: %s", w.path, err)
+		}
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate moves the current file to path.1, shifting the older ones,
+// and starts a new file on the next write.
+func (w *KeyLogWriter) Rotate() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.rotate()
+}
+
+// Close closes the file, the next write opens it again.
+func (w *KeyLogWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.close()
+}
+
+func (w *KeyLogWriter) open() error {
+	// Session keys are secrets, only the owner may read them.
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *KeyLogWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	w.size = 0
+	return err
+}
+
+func (w *KeyLogWriter) rotate() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	if w.maxBackups <= 0 {
+		err := os.Remove(w.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	for i := w.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(w.backupName(i), w.backupName(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := os.Rename(w.path, w.backupName(1))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (w *KeyLogWriter) backupName(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
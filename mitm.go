@@ -0,0 +1,146 @@
+package proxychannel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// mitmByConfig decides whether a CONNECT should be MITM'd according to the configuration.
+// Excluded hosts and hosts whose clients rejected MITM certificates are tunneled, the legacy "MITM: Enabled" header always
+// enables MITM, and otherwise DecryptHTTPS does, limited to MITMHosts if any.
+func (p *Proxy) mitmByConfig(ctx *Context) bool {
+	host := ctx.Req.URL.Host
+	if matchHostPatterns(p.mitmExcludeHosts, host) {
+		return false
+	}
+	if p.mitmBypass != nil && p.mitmBypass.Bypassed(host) {
+		Logger.Infof("mitmByConfig %s rejected MITM certificates before, tunnel it", host)
+		return false
+	}
+	if ctx.Req.Header.Get("MITM") == "Enabled" {
+		return true
+	}
+	if !p.decryptHTTPS {
+		return false
+	}
+	return len(p.mitmHosts) == 0 || matchHostPatterns(p.mitmHosts, host)
+}
+
+// mitmTLSConfig returns the tls.Config presented to the client of a MITM'd CONNECT.
+// The certificate is chosen during the handshake from the ClientHello, which is
+// recorded in ctx.ClientHello. Generation failures are stored in ctx with errType.
+func (p *Proxy) mitmTLSConfig(ctx *Context, errType string) (*tls.Config, error) {
+	if p.cert.CA() == nil {
+		return nil, fmt.Errorf("no MITM root CA configured")
+	}
+	connectHost := ctx.Req.URL.Host
+	return &tls.Config{
+		KeyLogWriter: p.keyLogWriter,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			ctx.ClientHello = &ClientHello{
+				ServerName:        hello.ServerName,
+				SupportedProtos:   hello.SupportedProtos,
+				CipherSuites:      hello.CipherSuites,
+				SupportedVersions: hello.SupportedVersions,
+			}
+			// The client may ask for another name than the CONNECT authority,
+			// e.g. when it CONNECTs to an IP address.
+			host := connectHost
+			if hello.ServerName != "" {
+				host = hello.ServerName
+			}
+			var upstream func() (*x509.Certificate, error)
+			if p.mirrorUpstreamCert {
+				upstream = func() (*x509.Certificate, error) {
+					c, err := p.fetchUpstreamCertificate(ctx, connectHost, hello.ServerName)
+					if err != nil {
+						Logger.Warningf("mitmTLSConfig %s fetch upstream certificate failed, fall back to template: %s", connectHost, err)
+						return nil, nil
+					}
+					return c, nil
+				}
+			}
+			c, err := p.cert.GetCertificate(host, upstream)
+			if err != nil {
+				Logger.Errorf("mitmTLSConfig %s generate certificate for %s failed: %s", connectHost, host, err)
+				ctx.SetContextErrorWithType(err, errType)
+				return nil, err
+			}
+			ctx.certSent = true
+			return c, nil
+		},
+	}, nil
+}
+
+// mitmHandshakeFailed records a failed client handshake, unless it failed
+// because the certificate could not be generated. Only clients that rejected
+// the certificate count for MITMBypass, not those that failed before getting
+// it, e.g. scanners and idle connections, which could turn MITM off for a host.
+func (p *Proxy) mitmHandshakeFailed(ctx *Context, err error, errType string, generateErrType string) {
+	if t, _ := ctx.GetContextError(); t == generateErrType {
+		return
+	}
+	ctx.SetContextErrorWithType(err, errType)
+	if p.mitmBypass != nil && ctx.certSent && rejectedCertificate(err) {
+		p.mitmBypass.Failed(ctx.Req.URL.Host)
+	}
+}
+
+// rejectedCertificate checks whether err, the error of a server handshake that
+// sent its certificate, is the client rejecting it: with an alert, or by
+// closing the connection, as clients that pin certificates may do.
+func rejectedCertificate(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// mitmHandshakeSucceeded resets the failures counted for MITMBypass.
+func (p *Proxy) mitmHandshakeSucceeded(ctx *Context) {
+	if p.mitmBypass != nil {
+		p.mitmBypass.Succeeded(ctx.Req.URL.Host)
+	}
+}
+
+// MITMBypass returns the hosts learned to be tunneled instead of MITM'd,
+// nil if MITMFailureThreshold is not set.
+func (p *Proxy) MITMBypass() *MITMBypass {
+	return p.mitmBypass
+}
+
+// fetchUpstreamCertificate connects to addr the way the CONNECT of ctx is forwarded,
+// through its parent proxies if any, and returns the leaf certificate it presents
+// for serverName. The certificate is only used as a template, so it is not verified here.
+func (p *Proxy) fetchUpstreamCertificate(ctx *Context, addr string, serverName string) (*x509.Certificate, error) {
+	parentProxies, err := p.parentProxies(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.dialTunnel(ctx, parentProxies, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	tlsConfig := p.upstreamTLSConfig(addr)
+	if serverName != "" {
+		tlsConfig.ServerName = serverName
+	}
+	tlsConfig.InsecureSkipVerify = true
+	tlsConn := tls.Client(conn, tlsConfig)
+	host, _, _ := net.SplitHostPort(addr)
+	if err := handshakeUpstream(tlsConn, host); err != nil {
+		return nil, err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s presented no certificate", addr)
+	}
+	return certs[0], nil
+}
@@ -0,0 +1,72 @@
+package proxychannel
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestMITMHandshakeFailedCountsRejections(t *testing.T) {
+	tests := []struct {
+		name    string
+		client  func(conn net.Conn)
+		counted bool
+	}{
+		{"closed before ClientHello", func(conn net.Conn) {
+			conn.Close()
+		}, false},
+		{"not TLS", func(conn net.Conn) {
+			conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+			conn.Close()
+		}, false},
+		{"certificate rejected with an alert", func(conn net.Conn) {
+			tls.Client(conn, &tls.Config{ServerName: "example.com"}).Handshake()
+			conn.Close()
+		}, true},
+		{"closed once the certificate came", func(conn net.Conn) {
+			tls.Client(conn, &tls.Config{
+				InsecureSkipVerify: true,
+				VerifyConnection: func(tls.ConnectionState) error {
+					conn.Close()
+					return errors.New("pinned")
+				},
+			}).Handshake()
+		}, true},
+		{"certificate accepted", func(conn net.Conn) {
+			tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+			conn.Close()
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hconf := *DefaultHandlerConfig
+			hconf.UseBuiltinCA = true
+			hconf.Transport = nil
+			hconf.MITMFailureThreshold = 1
+			p := NewProxy(&hconf, NewExtensionManager(map[string]Extension{}))
+			req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Host: "example.com:443"}, Host: "example.com:443", Header: http.Header{}}
+			ctx := &Context{Req: req}
+			tlsConfig, err := p.mitmTLSConfig(ctx, HTTPSGenerateTLSConfigFail)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clientConn, proxyConn := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				tt.client(clientConn)
+			}()
+			p.serveMITM(ctx, nil, proxyConn, tlsConfig)
+			clientConn.Close()
+			<-done
+
+			if got := p.MITMBypass().Bypassed("example.com:443"); got != tt.counted {
+				t.Errorf("counted = %v, want %v (handshake error %v)", got, tt.counted, ctx.Err)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package proxychannel
+
+import (
+	"sync"
+	"time"
+)
+
+// maxMITMBypassHosts caps the hosts a MITMBypass keeps track of.
+const maxMITMBypassHosts = 10000
+
+// MITMBypass remembers the hosts whose clients keep rejecting the forged
+// certificate, e.g. because they pin certificates. Once a host has failed
+// threshold handshakes in a row, each within ttl of the previous one,
+// it is tunneled instead of MITM'd for ttl.
+type MITMBypass struct {
+	threshold int
+	ttl       time.Duration
+
+	lock  sync.Mutex
+	hosts map[string]*bypassEntry
+}
+
+type bypassEntry struct {
+	failures int
+	last     time.Time // of the last failure
+	until    time.Time // bypassed until then, zero if not bypassed
+}
+
+// NewMITMBypass creates a MITMBypass.
+func NewMITMBypass(threshold int, ttl time.Duration) *MITMBypass {
+	return &MITMBypass{
+		threshold: threshold,
+		ttl:       ttl,
+		hosts:     make(map[string]*bypassEntry),
+	}
+}
+
+// Failed records a failed MITM handshake with a client of host.
+func (b *MITMBypass) Failed(host string) {
+	now := time.Now()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	e, ok := b.hosts[host]
+	if !ok {
+		if len(b.hosts) >= maxMITMBypassHosts {
+			b.evict(now)
+		}
+		e = &bypassEntry{}
+		b.hosts[host] = e
+	} else if b.stale(e, now) {
+		*e = bypassEntry{}
+	}
+	e.failures++
+	e.last = now
+	if e.failures >= b.threshold {
+		e.until = time.Now().Add(b.ttl)
+		Logger.Warningf("MITMBypass %s failed %d MITM handshakes, tunnel it until %s", host, e.failures, e.until.Format(DefaultLogTimeFormat))
+	}
+}
+
+// stale checks whether e is no longer of use: its bypass is over, or its
+// failures are too old to count.
+func (b *MITMBypass) stale(e *bypassEntry, now time.Time) bool {
+	if !e.until.IsZero() {
+		return now.After(e.until)
+	}
+	return now.Sub(e.last) > b.ttl
+}
+
+// evict makes room for a host, dropping the stale entries, or the one whose
+// last failure is the oldest if there are none.
+func (b *MITMBypass) evict(now time.Time) {
+	var oldest string
+	for host, e := range b.hosts {
+		if b.stale(e, now) {
+			delete(b.hosts, host)
+		} else if oldest == "" || e.last.Before(b.hosts[oldest].last) {
+			oldest = host
+		}
+	}
+	if len(b.hosts) >= maxMITMBypassHosts {
+		delete(b.hosts, oldest)
+	}
+}
+
+// Succeeded records a successful MITM handshake with a client of host.
+func (b *MITMBypass) Succeeded(host string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.hosts, host)
+}
+
+// Bypassed checks whether host should be tunneled instead of MITM'd.
+func (b *MITMBypass) Bypassed(host string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	e, ok := b.hosts[host]
+	if !ok || e.until.IsZero() {
+		return false
+	}
+	if time.Now().After(e.until) {
+		delete(b.hosts, host)
+		return false
+	}
+	return true
+}
+
+// Hosts returns the bypassed hosts and until when they are bypassed.
+func (b *MITMBypass) Hosts() map[string]time.Time {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	hosts := make(map[string]time.Time)
+	for host, e := range b.hosts {
+		if !e.until.IsZero() && now.Before(e.until) {
+			hosts[host] = e.until
+		}
+	}
+	return hosts
+}
+
+// Clear forgets what was learned about hosts, or about every host if none is given.
+func (b *MITMBypass) Clear(hosts ...string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(hosts) == 0 {
+		b.hosts = make(map[string]*bypassEntry)
+		return
+	}
+	for _, host := range hosts {
+		delete(b.hosts, host)
+	}
+}
@@ -0,0 +1,92 @@
+package proxychannel
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMITMBypass(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		ttl       time.Duration
+		events    string // F for Failed, S for Succeeded
+		wait      time.Duration
+		want      bool
+	}{
+		{"unknown host", 2, time.Minute, "", 0, false},
+		{"below threshold", 2, time.Minute, "F", 0, false},
+		{"threshold reached", 2, time.Minute, "FF", 0, true},
+		{"past threshold", 2, time.Minute, "FFF", 0, true},
+		{"success resets failures", 2, time.Minute, "FSF", 0, false},
+		{"success ends bypass", 2, time.Minute, "FFS", 0, false},
+		{"threshold of one", 1, time.Minute, "F", 0, true},
+		{"ttl elapsed", 1, 20 * time.Millisecond, "F", 50 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMITMBypass(tt.threshold, tt.ttl)
+			for _, e := range tt.events {
+				if e == 'F' {
+					b.Failed("example.com:443")
+				} else {
+					b.Succeeded("example.com:443")
+				}
+			}
+			time.Sleep(tt.wait)
+			if got := b.Bypassed("example.com:443"); got != tt.want {
+				t.Errorf("Bypassed = %v, want %v", got, tt.want)
+			}
+			if _, got := b.Hosts()["example.com:443"]; got != tt.want {
+				t.Errorf("in Hosts = %v, want %v", got, tt.want)
+			}
+			if b.Bypassed("other.com:443") {
+				t.Error("other host is bypassed")
+			}
+		})
+	}
+}
+
+func TestMITMBypassClear(t *testing.T) {
+	b := NewMITMBypass(1, time.Minute)
+	b.Failed("a:443")
+	b.Failed("b:443")
+	b.Failed("c:443")
+	b.Clear("a:443")
+	if b.Bypassed("a:443") || !b.Bypassed("b:443") {
+		t.Fatalf("Clear(a) left %v", b.Hosts())
+	}
+	b.Clear()
+	if hosts := b.Hosts(); len(hosts) != 0 {
+		t.Fatalf("Clear() left %v", hosts)
+	}
+}
+
+func TestMITMBypassFailuresApart(t *testing.T) {
+	b := NewMITMBypass(2, 20*time.Millisecond)
+	b.Failed("example.com:443")
+	time.Sleep(50 * time.Millisecond)
+	b.Failed("example.com:443")
+	if b.Bypassed("example.com:443") {
+		t.Error("failures further apart than ttl were counted in a row")
+	}
+	b.Failed("example.com:443")
+	if !b.Bypassed("example.com:443") {
+		t.Error("failures within ttl were not counted in a row")
+	}
+}
+
+func TestMITMBypassMaxHosts(t *testing.T) {
+	b := NewMITMBypass(2, time.Minute)
+	b.Failed("first:443")
+	for i := 0; i < maxMITMBypassHosts; i++ {
+		b.Failed(fmt.Sprintf("host%d:443", i))
+	}
+	if len(b.hosts) != maxMITMBypassHosts {
+		t.Fatalf("%d hosts kept, want %d", len(b.hosts), maxMITMBypassHosts)
+	}
+	if _, ok := b.hosts["first:443"]; ok {
+		t.Error("the host whose last failure is the oldest was not evicted")
+	}
+}
@@ -0,0 +1,459 @@
+package proxychannel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+const (
+	// pacEvalTimeout bounds a FindProxyForURL call, PAC scripts may loop forever.
+	pacEvalTimeout = 5 * time.Second
+	// pacDNSTimeout bounds the lookups of dnsResolve and the helpers using it.
+	pacDNSTimeout = 2 * time.Second
+)
+
+// PAC picks the parent proxy of requests with the FindProxyForURL function of a
+// proxy auto-config script, which is run by an embedded JavaScript engine.
+//
+// FindProxyForURL returns a list like "PROXY a:8080; SOCKS5 b:1080; DIRECT", which
+// is tried in order: the next entry is used when a proxy cannot be connected to,
+// and a proxy that failed is tried last for retry. PROXY and HTTP map to http:// parents,
+// HTTPS to https:// ones, SOCKS and SOCKS5 to socks5:// ones and DIRECT to no parent.
+type PAC struct {
+	path  string
+	retry time.Duration
+
+	script atomic.Value // *pacScript
+
+	lock sync.Mutex
+	down map[string]time.Time // proxy URL -> skipped until then
+}
+
+// pacScript is a compiled PAC script with a pool of runtimes that ran it,
+// a goja.Runtime cannot be used by several goroutines at once.
+type pacScript struct {
+	program  *goja.Program
+	runtimes sync.Pool
+}
+
+// NewPAC creates a PAC from script. A proxy that failed is skipped for retry.
+func NewPAC(script string, retry time.Duration) (*PAC, error) {
+	p := &PAC{retry: retry, down: make(map[string]time.Time)}
+	if err := p.Update(script); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadPAC creates a PAC from the script in file path.
+func LoadPAC(path string, retry time.Duration) (*PAC, error) {
+	p := &PAC{path: path, retry: retry, down: make(map[string]time.Time)}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the file of a PAC created by LoadPAC again.
+// The script in use is kept if the file cannot be loaded.
+func (p *PAC) Reload() error {
+	if p.path == "" {
+		return errors.New("PAC was not loaded from a file")
+	}
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	if err := p.Update(string(data)); err != nil {
+		return fmt.Errorf("load %s failed: %s", p.path, err)
+	}
+	Logger.Infof("PAC loaded %s", p.path)
+	return nil
+}
+
+// Update replaces the script of the PAC.
+// The script in use is kept if script cannot be run.
+func (p *PAC) Update(script string) error {
+	program, err := goja.Compile("pac", script, false)
+	if err != nil {
+		return err
+	}
+	s := &pacScript{program: program}
+	// Run it once, so that a script without FindProxyForURL or
+	// failing at the top level is rejected now.
+	rt, err := s.newRuntime()
+	if err != nil {
+		return err
+	}
+	s.runtimes.Put(rt)
+	p.script.Store(s)
+	return nil
+}
+
+// FindProxy calls FindProxyForURL and returns the parent proxies of its result
+// in order, DIRECT is a nil URL.
+func (p *PAC) FindProxy(rawURL string, host string) ([]*url.URL, error) {
+	s := p.script.Load().(*pacScript)
+	result, err := s.findProxyForURL(rawURL, host)
+	if err != nil {
+		return nil, err
+	}
+	return parsePACResult(result), nil
+}
+
+// ParentProxy can be returned by the ParentProxy method of a Delegate.
+// It returns the first entry of the result, and the others are left in
+// ctx.ParentProxyFallbacks. Like browsers do, requests go direct if the script fails.
+func (p *PAC) ParentProxy(ctx *Context, i interface{}) (*url.URL, error) {
+	rawURL, host := pacURL(ctx.Req)
+	proxies, err := p.FindProxy(rawURL, host)
+	if err != nil {
+		Logger.Errorf("PAC FindProxyForURL(%s, %s) failed: %s", rawURL, host, err)
+		return nil, nil
+	}
+	proxies = p.order(proxies)
+	ctx.ParentProxyFallbacks = proxies[1:]
+	return proxies[0], nil
+}
+
+// Failed records that proxy failed, it is skipped for the retry interval.
+func (p *PAC) Failed(proxy *url.URL) {
+	if proxy == nil {
+		return
+	}
+	until := time.Now().Add(p.retry)
+	p.lock.Lock()
+	p.down[proxy.String()] = until
+	p.lock.Unlock()
+	Logger.Warningf("PAC parent proxy %s failed, skip it until %s", proxy.Host, until.Format(DefaultLogTimeFormat))
+}
+
+// order moves the proxies that are skipped after the others, keeping the order of both.
+func (p *PAC) order(proxies []*url.URL) []*url.URL {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	ordered := make([]*url.URL, 0, len(proxies))
+	var skipped []*url.URL
+	for _, proxy := range proxies {
+		if proxy != nil {
+			if until, ok := p.down[proxy.String()]; ok {
+				if now.Before(until) {
+					skipped = append(skipped, proxy)
+					continue
+				}
+				delete(p.down, proxy.String())
+			}
+		}
+		ordered = append(ordered, proxy)
+	}
+	return append(ordered, skipped...)
+}
+
+// PACDelegate is a DefaultDelegate whose parent proxies are picked by PAC.
+// Parent proxies that could not be connected to are reported to PAC.Failed.
+// Embed it in a Delegate to get PAC based routing.
+type PACDelegate struct {
+	DefaultDelegate
+	PAC *PAC
+}
+
+// ParentProxy .
+func (d *PACDelegate) ParentProxy(ctx *Context, i interface{}) (*url.URL, error) {
+	return d.PAC.ParentProxy(ctx, i)
+}
+
+// Finish .
+func (d *PACDelegate) Finish(ctx *Context, rw http.ResponseWriter) {
+	for _, proxy := range ctx.FailedParentProxies {
+		d.PAC.Failed(proxy)
+	}
+}
+
+// pacURL returns the arguments of FindProxyForURL for req. Like browsers do,
+// the path of https:// URLs is not given to the script.
+func pacURL(req *http.Request) (string, string) {
+	host := req.URL.Hostname()
+	if req.Method == http.MethodConnect {
+		if req.URL.Port() == "443" {
+			return "https://" + host + "/", host
+		}
+		return "https://" + req.URL.Host + "/", host
+	}
+	u := *req.URL
+	u.User = nil
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		u.Path, u.RawPath, u.RawQuery = "/", "", ""
+	}
+	return u.String(), host
+}
+
+// parsePACResult parses the result of FindProxyForURL. Unsupported entries
+// are skipped, and an empty result means DIRECT.
+func parsePACResult(result string) []*url.URL {
+	var proxies []*url.URL
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.EqualFold(fields[0], "DIRECT") {
+			proxies = append(proxies, nil)
+			continue
+		}
+		if len(fields) != 2 {
+			Logger.Warningf("PAC result entry %q is invalid", strings.TrimSpace(entry))
+			continue
+		}
+		var scheme string
+		switch strings.ToUpper(fields[0]) {
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		default:
+			Logger.Warningf("PAC result entry %q is not supported", strings.TrimSpace(entry))
+			continue
+		}
+		proxies = append(proxies, &url.URL{Scheme: scheme, Host: fields[1]})
+	}
+	if len(proxies) == 0 {
+		proxies = append(proxies, nil)
+	}
+	return proxies
+}
+
+func (s *pacScript) findProxyForURL(rawURL string, host string) (string, error) {
+	rt, _ := s.runtimes.Get().(*goja.Runtime)
+	if rt == nil {
+		var err error
+		if rt, err = s.newRuntime(); err != nil {
+			return "", err
+		}
+	}
+	fn, ok := goja.AssertFunction(rt.Get("FindProxyForURL"))
+	if !ok {
+		return "", errors.New("FindProxyForURL is not a function")
+	}
+	timer := time.AfterFunc(pacEvalTimeout, func() {
+		rt.Interrupt("FindProxyForURL timed out")
+	})
+	v, err := fn(goja.Undefined(), rt.ToValue(rawURL), rt.ToValue(host))
+	if timer.Stop() {
+		// Otherwise the runtime was interrupted, or is about to be.
+		s.runtimes.Put(rt)
+	}
+	if err != nil {
+		return "", err
+	}
+	if goja.IsUndefined(v) || goja.IsNull(v) {
+		return "", nil
+	}
+	return v.String(), nil
+}
+
+func (s *pacScript) newRuntime() (*goja.Runtime, error) {
+	rt := goja.New()
+	rt.Set("dnsResolve", pacDNSResolve)
+	rt.Set("myIpAddress", pacMyIPAddress)
+	rt.Set("alert", func(msg string) {
+		Logger.Infof("PAC alert: %s", msg)
+	})
+	if _, err := rt.RunProgram(pacUtils); err != nil {
+		return nil, err
+	}
+	timer := time.AfterFunc(pacEvalTimeout, func() {
+		rt.Interrupt("PAC script timed out")
+	})
+	defer timer.Stop()
+	if _, err := rt.RunProgram(s.program); err != nil {
+		return nil, err
+	}
+	if _, ok := goja.AssertFunction(rt.Get("FindProxyForURL")); !ok {
+		return nil, errors.New("FindProxyForURL is not defined")
+	}
+	return rt, nil
+}
+
+// pacDNSResolve returns an IPv4 address of host, or null.
+func pacDNSResolve(host string) interface{} {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pacDNSTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			return ip4.String()
+		}
+	}
+	return addrs[0].IP.String()
+}
+
+// pacMyIPAddress returns the address of the interface of the default route.
+func pacMyIPAddress() string {
+	// Nothing is sent, connecting a UDP socket only selects the route.
+	conn, err := net.Dial("udp", "198.51.100.1:53")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// pacUtils are the standard PAC helpers that need no Go.
+var pacUtils = goja.MustCompile("pacutils", `
+function isPlainHostName(host) {
+	return host.indexOf('.') == -1;
+}
+
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length &&
+		host.substring(host.length - domain.length) == domain;
+}
+
+function localHostOrDomainIs(host, hostdom) {
+	return host == hostdom || hostdom.lastIndexOf(host + '.', 0) == 0;
+}
+
+function isResolvable(host) {
+	return dnsResolve(host) != null;
+}
+
+function dnsDomainLevels(host) {
+	return host.split('.').length - 1;
+}
+
+function convert_addr(ipchars) {
+	var bytes = ipchars.split('.');
+	return ((bytes[0] & 0xff) << 24) | ((bytes[1] & 0xff) << 16) |
+		((bytes[2] & 0xff) << 8) | (bytes[3] & 0xff);
+}
+
+function isInNet(ipaddr, pattern, maskstr) {
+	if (!/^\d+\.\d+\.\d+\.\d+$/.test(ipaddr)) {
+		ipaddr = dnsResolve(ipaddr);
+		if (ipaddr == null || !/^\d+\.\d+\.\d+\.\d+$/.test(ipaddr)) {
+			return false;
+		}
+	}
+	var mask = convert_addr(maskstr);
+	return (convert_addr(ipaddr) & mask) == (convert_addr(pattern) & mask);
+}
+
+function shExpMatch(str, shexp) {
+	var re = shexp.replace(/[.+^${}()|[\]\\]/g, '\\$&').replace(/\*/g, '.*').replace(/\?/g, '.');
+	return new RegExp('^' + re + '$').test(str);
+}
+
+var pacWeekdays = ['SUN', 'MON', 'TUE', 'WED', 'THU', 'FRI', 'SAT'];
+var pacMonths = ['JAN', 'FEB', 'MAR', 'APR', 'MAY', 'JUN', 'JUL', 'AUG', 'SEP', 'OCT', 'NOV', 'DEC'];
+
+// pacArgs returns the arguments without the trailing "GMT", and whether it was there.
+function pacArgs(args) {
+	args = Array.prototype.slice.call(args);
+	var gmt = args.length > 0 && args[args.length - 1] == 'GMT';
+	if (gmt) {
+		args.pop();
+	}
+	return {args: args, gmt: gmt};
+}
+
+function pacInRange(start, cur, end) {
+	return start <= end ? start <= cur && cur <= end : cur >= start || cur <= end;
+}
+
+function weekdayRange() {
+	var a = pacArgs(arguments);
+	var now = new Date();
+	var day = a.gmt ? now.getUTCDay() : now.getDay();
+	var wd1 = pacWeekdays.indexOf(a.args[0]);
+	if (wd1 < 0) {
+		return false;
+	}
+	if (a.args.length < 2) {
+		return day == wd1;
+	}
+	var wd2 = pacWeekdays.indexOf(a.args[1]);
+	return wd2 >= 0 && pacInRange(wd1, day, wd2);
+}
+
+function dateRange() {
+	var a = pacArgs(arguments);
+	var now = new Date();
+	var cur = {
+		day: a.gmt ? now.getUTCDate() : now.getDate(),
+		month: a.gmt ? now.getUTCMonth() : now.getMonth(),
+		year: a.gmt ? now.getUTCFullYear() : now.getFullYear()
+	};
+	// Dates are compared as yyyymmdd numbers made of the fields given.
+	function date(args) {
+		var d = {day: 0, month: 0, year: 0}, c = {day: 0, month: 0, year: 0};
+		for (var i = 0; i < args.length; i++) {
+			var v = args[i];
+			if (typeof v == 'string') {
+				d.month = pacMonths.indexOf(v);
+				c.month = cur.month;
+			} else if (v > 31) {
+				d.year = v;
+				c.year = cur.year;
+			} else {
+				d.day = v;
+				c.day = cur.day;
+			}
+		}
+		return {d: d.year * 10000 + d.month * 100 + d.day, c: c.year * 10000 + c.month * 100 + c.day};
+	}
+	var n = a.args.length;
+	if (n == 0 || n > 6) {
+		return false;
+	}
+	if (n % 2 == 1) {
+		var single = date(a.args);
+		return single.d == single.c;
+	}
+	var start = date(a.args.slice(0, n / 2)), end = date(a.args.slice(n / 2));
+	return pacInRange(start.d, start.c, end.d);
+}
+
+function timeRange() {
+	var a = pacArgs(arguments);
+	var now = new Date();
+	var h = a.gmt ? now.getUTCHours() : now.getHours();
+	var m = a.gmt ? now.getUTCMinutes() : now.getMinutes();
+	var s = a.gmt ? now.getUTCSeconds() : now.getSeconds();
+	var args = a.args;
+	switch (args.length) {
+	case 1:
+		return h == args[0];
+	case 2:
+		return args[0] <= args[1] ? args[0] <= h && h < args[1] : h >= args[0] || h < args[1];
+	case 4:
+		return pacInRange(args[0] * 60 + args[1], h * 60 + m, args[2] * 60 + args[3]);
+	case 6:
+		return pacInRange(args[0] * 3600 + args[1] * 60 + args[2], h * 3600 + m * 60 + s,
+			args[3] * 3600 + args[4] * 60 + args[5]);
+	}
+	return false;
+}
+`, false)
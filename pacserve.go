@@ -0,0 +1,129 @@
+package proxychannel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Paths of the PAC file served when HandlerConfig.ServePAC is set.
+const (
+	PACPath  = "/proxy.pac"
+	WPADPath = "/wpad.dat"
+)
+
+// isPACRequest checks whether req asks the proxy itself for its PAC file.
+// Proxy requests have an absolute URL, requests sent to the proxy itself do not.
+func (p *Proxy) isPACRequest(req *http.Request) bool {
+	if !p.servePAC || req.URL.Host != "" || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return false
+	}
+	return req.URL.Path == PACPath || req.URL.Path == WPADPath
+}
+
+// writePAC answers the PAC file generated from PACProxyAddrs and PACBypass.
+func (p *Proxy) writePAC(rw http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok && host == "" {
+		host = addr.IP.String()
+	}
+	script := generatePAC(pacProxyList(p.pacProxyAddrs, host), p.pacBypass)
+	Logger.Infof("Serve %s to %s", req.URL.Path, req.RemoteAddr)
+	rw.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	rw.Header().Set("Content-Length", fmt.Sprint(len(script)))
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		rw.Write([]byte(script))
+	}
+}
+
+// pacProxyList returns the FindProxyForURL result pointing to addrs, which
+// are host:port or https:// and socks5:// URLs. Missing or unspecified hosts
+// are replaced with host, the one the PAC file was fetched from.
+func pacProxyList(addrs []string, host string) string {
+	var entries []string
+	for _, addr := range addrs {
+		keyword := "PROXY"
+		if u, err := url.Parse(addr); err == nil && u.Host != "" {
+			switch u.Scheme {
+			case "https":
+				keyword = "HTTPS"
+			case "socks5", "socks5h":
+				keyword = "SOCKS5"
+			}
+			addr = u.Host
+		}
+		h, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			Logger.Warningf("PAC proxy address %s is invalid: %s", addr, err)
+			continue
+		}
+		if ip := net.ParseIP(h); h == "" || ip != nil && ip.IsUnspecified() {
+			h = host
+		}
+		entries = append(entries, keyword+" "+net.JoinHostPort(h, port))
+	}
+	if len(entries) == 0 {
+		return "DIRECT"
+	}
+	return strings.Join(entries, "; ")
+}
+
+// pacBypassConditions turns the entries of PACBypass into FindProxyForURL
+// conditions: "<local>" matches plain host names, CIDRs match IPv4 addresses
+// and the rest are host patterns, see matchHostPattern.
+func pacBypassConditions(bypass []string) []string {
+	var conds []string
+	for _, entry := range bypass {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case entry == "<local>":
+			conds = append(conds, "isPlainHostName(host)")
+		case strings.Contains(entry, "/"):
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil || n.IP.To4() == nil {
+				// isInNet only knows IPv4.
+				Logger.Warningf("PAC bypass %s is not an IPv4 CIDR", entry)
+				continue
+			}
+			conds = append(conds, fmt.Sprintf("isIPv4 && isInNet(host, %s, %s)", jsString(n.IP.String()), jsString(net.IP(n.Mask).String())))
+		case entry == "*":
+			conds = append(conds, "true")
+		case strings.HasPrefix(entry, "*."):
+			conds = append(conds, fmt.Sprintf("dnsDomainIs(host, %s)", jsString(entry[1:])))
+		case strings.HasPrefix(entry, "."):
+			conds = append(conds, fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", jsString(entry[1:]), jsString(entry)))
+		default:
+			conds = append(conds, fmt.Sprintf("host == %s", jsString(entry)))
+		}
+	}
+	return conds
+}
+
+// generatePAC returns a PAC script sending everything to proxies, except
+// the hosts matching one of the bypass conditions, which go direct.
+func generatePAC(proxies string, bypass []string) string {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\thost = host.toLowerCase();\n")
+	b.WriteString("\tvar isIPv4 = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host);\n")
+	for _, cond := range bypass {
+		fmt.Fprintf(&b, "\tif (%s) {\n\t\treturn \"DIRECT\";\n\t}\n", cond)
+	}
+	fmt.Fprintf(&b, "\treturn %s;\n}\n", jsString(proxies))
+	return b.String()
+}
+
+// jsString quotes s as a JavaScript string literal.
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
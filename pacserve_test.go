@@ -0,0 +1,94 @@
+package proxychannel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPACBypassConditions(t *testing.T) {
+	tests := []struct {
+		bypass []string
+		want   []string
+	}{
+		{nil, nil},
+		{[]string{"", "  "}, nil},
+		{[]string{"<local>", "<LOCAL>"}, []string{"isPlainHostName(host)", "isPlainHostName(host)"}},
+		{[]string{"*"}, []string{"true"}},
+		{[]string{"*.Example.com"}, []string{`dnsDomainIs(host, ".example.com")`}},
+		{[]string{".example.com"}, []string{`host == "example.com" || dnsDomainIs(host, ".example.com")`}},
+		{[]string{"example.com"}, []string{`host == "example.com"`}},
+		{[]string{"10.1.2.3/8"}, []string{`isIPv4 && isInNet(host, "10.0.0.0", "255.0.0.0")`}},
+		{[]string{"fd00::/8", "10.0.0.0/33"}, nil},
+		{[]string{`a"b`}, []string{`host == "a\"b"`}},
+	}
+	for _, tt := range tests {
+		if got := pacBypassConditions(tt.bypass); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pacBypassConditions(%q) = %q, want %q", tt.bypass, got, tt.want)
+		}
+	}
+}
+
+func TestGeneratedPACBypass(t *testing.T) {
+	bypass := []string{"<local>", "*.internal.example.com", ".corp.example.com", "example.org", "10.0.0.0/8"}
+	p, err := NewPAC(generatePAC("PROXY proxy:8080; DIRECT", pacBypassConditions(bypass)), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host   string
+		direct bool
+	}{
+		{"intranet", true},
+		{"www.internal.example.com", true},
+		{"internal.example.com", false},
+		{"corp.example.com", true},
+		{"WWW.Corp.Example.com", true},
+		{"example.org", true},
+		{"www.example.org", false},
+		{"10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		proxies, err := p.FindProxy("http://"+tt.host+"/", tt.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if direct := proxies[0] == nil; direct != tt.direct {
+			t.Errorf("FindProxy(%s) = %v, want direct %v", tt.host, proxies, tt.direct)
+		}
+	}
+}
+
+func TestServeHTTPSelfRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		servePAC bool
+		method   string
+		target   string
+		want     int
+	}{
+		{"pac", true, http.MethodGet, PACPath, http.StatusOK},
+		{"wpad", true, http.MethodHead, WPADPath, http.StatusOK},
+		{"pac not served", false, http.MethodGet, PACPath, http.StatusNotFound},
+		{"pac posted", true, http.MethodPost, PACPath, http.StatusNotFound},
+		{"other path", true, http.MethodGet, "/", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hconf := *DefaultHandlerConfig
+			hconf.Transport = nil
+			hconf.ServePAC = tt.servePAC
+			hconf.PACProxyAddrs = []string{":8080"}
+			p := NewProxy(&hconf, NewExtensionManager(map[string]Extension{}))
+			rw := httptest.NewRecorder()
+			p.ServeHTTP(rw, httptest.NewRequest(tt.method, tt.target, nil))
+			if rw.Code != tt.want {
+				t.Errorf("%s %s answered %d, want %d", tt.method, tt.target, rw.Code, tt.want)
+			}
+		})
+	}
+}
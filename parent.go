@@ -0,0 +1,381 @@
+package proxychannel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ParentProxyError is returned when a hop of the parent proxy chain fails,
+// because it cannot be reached or because it fails to connect to the next hop.
+type ParentProxyError struct {
+	Hop   int    // 1-based index of the failed hop in the chain
+	Proxy string // host:port of the failed hop
+	Err   error
+}
+
+// Error .
+func (e *ParentProxyError) Error() string {
+	return fmt.Sprintf("parent proxy hop %d (%s) failed: %s", e.Hop, e.Proxy, e.Err)
+}
+
+// Unwrap .
+func (e *ParentProxyError) Unwrap() error {
+	return e.Err
+}
+
+// parentProxies asks the Delegate for the parent proxy chain, falling back
+// to the single parent of ParentProxy, and records it in ctx.ParentProxies.
+func (p *Proxy) parentProxies(ctx *Context, i interface{}) ([]*url.URL, error) {
+	chain, err := p.delegate.ParentProxyChain(ctx, i)
+	if err == nil && len(chain) == 0 {
+		var parent *url.URL
+		parent, err = p.delegate.ParentProxy(ctx, i)
+		if parent != nil {
+			chain = []*url.URL{parent}
+		}
+	}
+	ctx.ParentProxies = chain
+	return chain, err
+}
+
+// withParentFallbacks calls dial with chain, the parent proxies of ctx, and then
+// with each of ctx.ParentProxyFallbacks as long as it fails because the parent
+// proxy cannot be connected to. ctx.ParentProxies is the chain dial was last called with.
+func (p *Proxy) withParentFallbacks(ctx *Context, chain []*url.URL, dial func(chain []*url.URL) error) error {
+	for {
+		err := dial(chain)
+		failed := failedParentProxy(chain, err)
+		if failed == nil {
+			return err
+		}
+		ctx.FailedParentProxies = append(ctx.FailedParentProxies, failed)
+		if len(ctx.ParentProxyFallbacks) == 0 {
+			return err
+		}
+		next := ctx.ParentProxyFallbacks[0]
+		ctx.ParentProxyFallbacks = ctx.ParentProxyFallbacks[1:]
+		chain = nil
+		if next != nil {
+			chain = []*url.URL{next}
+		}
+		ctx.ParentProxies = chain
+		Logger.Warningf("%s %s parent proxy %s failed, fall back to %s: %s", ctx.Req.Method, ctx.Req.URL.Host, failed.Host, describeParentProxies(chain), err)
+	}
+}
+
+// failedParentProxy returns the hop of chain that could not be connected to
+// or failed to connect to the next one, if that is why err happened.
+func failedParentProxy(chain []*url.URL, err error) *url.URL {
+	if err == nil || len(chain) == 0 {
+		return nil
+	}
+	var hopErr *ParentProxyError
+	if errors.As(err, &hopErr) && hopErr.Hop >= 1 && hopErr.Hop <= len(chain) {
+		return chain[hopErr.Hop-1]
+	}
+	// http.Transport dialing a single parent proxy.
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "proxyconnect" {
+		return chain[0]
+	}
+	return nil
+}
+
+// describeParentProxies returns the hosts of chain, or DIRECT if it is empty.
+func describeParentProxies(chain []*url.URL) string {
+	if len(chain) == 0 {
+		return "DIRECT"
+	}
+	hops := make([]string, len(chain))
+	for i, hop := range chain {
+		hops[i] = hop.Host
+	}
+	return strings.Join(hops, " -> ")
+}
+
+// parentTransportKey identifies a transport of Proxy.parentTransports.
+type parentTransportKey struct {
+	base   *http.Transport
+	chain  string
+	scheme string
+}
+
+// parentTransport returns the transport sending requests for targetScheme through chain.
+// http.Transport handles a single plain HTTP parent on its own, so base is returned for it.
+// Other chains get a transport of their own, so that pooled connections are never
+// reused for a request sent through another chain.
+func (p *Proxy) parentTransport(base *http.Transport, chain []*url.URL, targetScheme string) *http.Transport {
+	if len(chain) == 0 || len(chain) == 1 && chain[0].Scheme == "http" {
+		return base
+	}
+	hops := make([]string, len(chain))
+	for i, hop := range chain {
+		hops[i] = hop.String()
+	}
+	key := parentTransportKey{base: base, chain: strings.Join(hops, " "), scheme: targetScheme}
+	if tr, ok := p.parentTransports.Load(key); ok {
+		return tr.(*http.Transport)
+	}
+	tr := base.Clone()
+	switch {
+	case transportProxyURL(chain, targetScheme) == nil:
+		// The transport reaches the target through the whole chain as if it
+		// dialed it directly, and handshakes with it for https targets.
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dialChain(ctx, base.DialContext, chain, addr)
+		}
+	case isHTTPSProxy(chain[len(chain)-1]):
+		// Otherwise http.Transport would handshake with the last hop using
+		// TLSClientConfig, which is meant for origins.
+		tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dialProxy(ctx, base.DialContext, chain)
+		}
+	default:
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dialProxy(ctx, base.DialContext, chain)
+		}
+	}
+	actual, _ := p.parentTransports.LoadOrStore(key, tr)
+	return actual.(*http.Transport)
+}
+
+// transportProxyURL returns the proxy that the transport of parentTransport sends
+// requests for targetScheme to. http:// requests go to the last hop if it is an
+// HTTP or HTTPS proxy, so that it gets them in absolute-form. Everything else is
+// sent through a tunnel to the target, and nil is returned.
+func transportProxyURL(chain []*url.URL, targetScheme string) *url.URL {
+	if len(chain) == 0 {
+		return nil
+	}
+	last := chain[len(chain)-1]
+	if len(chain) == 1 && last.Scheme == "http" {
+		return last
+	}
+	if targetScheme == "http" && (last.Scheme == "http" || isHTTPSProxy(last)) {
+		return last
+	}
+	return nil
+}
+
+// isHTTPSProxy checks whether u is an https:// proxy URL.
+func isHTTPSProxy(u *url.URL) bool {
+	return u != nil && u.Scheme == "https"
+}
+
+// dialContextFunc is the signature of net.Dialer.DialContext.
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyProtocolClientKey is the key of the client address in the contexts of
+// dialProxy and dialChain, which is sent to the addresses in SendProxyProtocol.
+type proxyProtocolClientKey struct{}
+
+// dialContext returns the context of dialing for client, which may be nil.
+func dialContext(client net.Addr) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), proxyProtocolClientKey{}, client)
+	return context.WithTimeout(ctx, defaultTargetConnectTimeout)
+}
+
+// dialTarget connects to addr directly, for client.
+func (p *Proxy) dialTarget(addr string, client net.Addr) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, defaultTargetConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.sendProxyProtocol(conn, addr, client, conn.RemoteAddr()); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialTunnel connects to addr for the client of ctx, through chain, its parent
+// proxies, or directly, falling back to its ParentProxyFallbacks.
+func (p *Proxy) dialTunnel(ctx *Context, chain []*url.URL, addr string) (net.Conn, error) {
+	var conn net.Conn
+	err := p.withParentFallbacks(ctx, chain, func(chain []*url.URL) error {
+		var err error
+		if len(chain) > 0 {
+			conn, err = p.dialParentTunnel(chain, addr, ctx.ClientAddr)
+		} else {
+			conn, err = p.dialTarget(addr, ctx.ClientAddr)
+		}
+		return err
+	})
+	return conn, err
+}
+
+// dialParent connects to the HTTP or HTTPS parent proxy itself, for client.
+func (p *Proxy) dialParent(parent *url.URL, client net.Addr) (net.Conn, error) {
+	ctx, cancel := dialContext(client)
+	defer cancel()
+	return p.dialProxy(ctx, nil, []*url.URL{parent})
+}
+
+// dialParentTunnel connects to addr through chain, for client. The connection
+// can be used as if addr had been dialed directly.
+func (p *Proxy) dialParentTunnel(chain []*url.URL, addr string, client net.Addr) (net.Conn, error) {
+	ctx, cancel := dialContext(client)
+	defer cancel()
+	return p.dialChain(ctx, nil, chain, addr)
+}
+
+// dialChain connects to the last hop of chain and asks it to connect to addr.
+func (p *Proxy) dialChain(ctx context.Context, dial dialContextFunc, chain []*url.URL, addr string) (net.Conn, error) {
+	conn, err := p.dialProxy(ctx, dial, chain)
+	if err != nil {
+		return nil, err
+	}
+	last := chain[len(chain)-1]
+	tunnel, err := tunnelThrough(ctx, conn, last, addr)
+	if err != nil {
+		conn.Close()
+		return nil, &ParentProxyError{Hop: len(chain), Proxy: last.Host, Err: err}
+	}
+	conn = tunnel
+	client, _ := ctx.Value(proxyProtocolClientKey{}).(net.Addr)
+	if err := p.sendProxyProtocol(conn, addr, client, nil); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialProxy dials the first hop of chain with dial, or a net.Dialer if it is nil,
+// and asks every hop to connect to the next one, up to the last hop.
+// https:// hops are talked to over TLS, after the PROXY protocol header if any.
+func (p *Proxy) dialProxy(ctx context.Context, dial dialContextFunc, chain []*url.URL) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: defaultTargetConnectTimeout}).DialContext
+	}
+	client, _ := ctx.Value(proxyProtocolClientKey{}).(net.Addr)
+	var conn net.Conn
+	for i, hop := range chain {
+		hopAddr := withDefaultPort(hop.Host, hop.Scheme)
+		var dst net.Addr
+		if i == 0 {
+			c, err := dial(ctx, "tcp", hopAddr)
+			if err != nil {
+				return nil, &ParentProxyError{Hop: 1, Proxy: hop.Host, Err: err}
+			}
+			conn, dst = c, c.RemoteAddr()
+		} else {
+			tunnel, err := tunnelThrough(ctx, conn, chain[i-1], hopAddr)
+			if err != nil {
+				conn.Close()
+				return nil, &ParentProxyError{Hop: i, Proxy: chain[i-1].Host, Err: err}
+			}
+			conn = tunnel
+		}
+		if err := p.sendProxyProtocol(conn, hopAddr, client, dst); err != nil {
+			return nil, &ParentProxyError{Hop: i + 1, Proxy: hop.Host, Err: err}
+		}
+		if isHTTPSProxy(hop) {
+			c, err := p.parentTLSClient(ctx, conn, hop)
+			if err != nil {
+				return nil, &ParentProxyError{Hop: i + 1, Proxy: hop.Host, Err: err}
+			}
+			conn = c
+		}
+	}
+	return conn, nil
+}
+
+// tunnelThrough asks the proxy hop at the other end of conn to connect to addr,
+// with a SOCKS5 request or a CONNECT, and returns the connection to use for the tunnel.
+func tunnelThrough(ctx context.Context, conn net.Conn, hop *url.URL, addr string) (net.Conn, error) {
+	if isSOCKS5(hop) {
+		if err := socks5Connect(ctx, conn, hop, addr); err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return httpConnect(ctx, conn, hop, addr)
+}
+
+// parentTLSClient handshakes with the https:// parent proxy at the other end of conn.
+func (p *Proxy) parentTLSClient(ctx context.Context, conn net.Conn, parent *url.URL) (net.Conn, error) {
+	tlsConn := tls.Client(conn, p.parentTLSConfig(parent))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with parent proxy %s failed: %w", parent.Host, err)
+	}
+	return tlsConn, nil
+}
+
+// parentTLSConfig returns the config of the TLS connection to the https:// parent proxy.
+func (p *Proxy) parentTLSConfig(parent *url.URL) *tls.Config {
+	var c *tls.Config
+	if p.parentProxyTLSConfig != nil {
+		c = p.parentProxyTLSConfig.Clone()
+	} else {
+		c = &tls.Config{RootCAs: p.transport.TLSClientConfig.RootCAs}
+	}
+	if serverName, ok := p.parentProxyServerNames[parent.Host]; ok {
+		c.ServerName = serverName
+	} else if c.ServerName == "" {
+		c.ServerName = parent.Hostname()
+	}
+	return c
+}
+
+// httpConnect asks the HTTP proxy at the other end of conn to connect to addr,
+// and returns the connection to use for the tunnel.
+func httpConnect(ctx context.Context, conn net.Conn, parent *url.URL, addr string) (net.Conn, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTargetConnectTimeout)
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := parent.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("parent proxy %s refused to CONNECT %s: %s", parent.Host, addr, resp.Status)
+	}
+	// A server that speaks first, like SSH or SMTP, may have sent its greeting
+	// along with the response, so it is read from br before conn.
+	if br.Buffered() > 0 {
+		return &sniffedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// withDefaultPort appends the default port of scheme to host if it has none.
+func withDefaultPort(host string, scheme string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	switch scheme {
+	case "https", "wss":
+		return net.JoinHostPort(host, "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(host, "1080")
+	}
+	return net.JoinHostPort(host, "80")
+}
@@ -0,0 +1,83 @@
+package proxychannel
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// listenConnectParent starts a loopback HTTP proxy that answers every CONNECT
+// and then greets like a server-first origin, in the same write as the
+// response if coalesce is set.
+func listenConnectParent(t *testing.T, greeting string, coalesce bool) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				resp := "HTTP/1.1 200 Connection established\r\n\r\n"
+				if coalesce {
+					conn.Write([]byte(resp + greeting))
+				} else {
+					conn.Write([]byte(resp))
+					time.Sleep(50 * time.Millisecond)
+					conn.Write([]byte(greeting))
+				}
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestDialParentTunnelServerFirst(t *testing.T) {
+	const greeting = "SSH-2.0-OpenSSH_8.9\r\n"
+	tests := []struct {
+		name     string
+		coalesce bool
+	}{
+		{"greeting with the response", true},
+		{"greeting after the response", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := listenConnectParent(t, greeting, tt.coalesce)
+			defer l.Close()
+			hconf := *DefaultHandlerConfig
+			hconf.Transport = nil
+			p := NewProxy(&hconf, NewExtensionManager(map[string]Extension{}))
+
+			conn, err := p.dialParentTunnel([]*url.URL{{Scheme: "http", Host: l.Addr().String()}}, "origin.example:22", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			b := make([]byte, len(greeting))
+			if _, err := io.ReadFull(conn, b); err != nil || string(b) != greeting {
+				t.Fatalf("greeting = %q, %v, want %q", b, err, greeting)
+			}
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			b = make([]byte, len("ping"))
+			if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+				t.Fatalf("echo = %q, %v", b, err)
+			}
+		})
+	}
+}
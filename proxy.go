@@ -7,6 +7,7 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,11 +16,13 @@ import (
 	"net/http/httptrace"
 	"net/url"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/jmcvetta/randutil"
 	"github.com/spritesprite/proxychannel/cert"
+	"golang.org/x/net/http2"
 )
 
 // Default timeout values
@@ -27,10 +30,15 @@ const (
 	defaultTargetConnectTimeout   = 5 * time.Second
 	defaultTargetReadWriteTimeout = 30 * time.Second
 	defaultClientReadWriteTimeout = 30 * time.Second
+	defaultSOCKS5UDPIdleTimeout   = 2 * time.Minute
 )
 
 const defaultHTTPResponsePeekSize int = 4096
 
+// maxDrainBodyBytes is how much of a request body left unread is discarded to
+// serve another request on the connection, like net/http servers do.
+const maxDrainBodyBytes = 256 << 10
+
 // Canned HTTP responses
 var tunnelEstablishedResponseLine = []byte(fmt.Sprintf("HTTP/1.1 %d Connection established\r\n\r\n", http.StatusOK))
 var badGateway = fmt.Sprintf("HTTP/1.1 %d %s\r\n\r\n", http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
@@ -120,8 +128,36 @@ type Proxy struct {
 	clientConnNum int32
 	decryptHTTPS  bool
 	cert          *cert.Certificate
+	certCache     cert.Cache // in memory, in front of CertCacheDir if set
 	transport     *http.Transport
 	mode          int
+
+	mitmHosts          []string
+	mitmExcludeHosts   []string
+	mitmBypass         *MITMBypass
+	mirrorUpstreamCert bool
+	mitmIdleTimeout    time.Duration
+	h2Server           *http2.Server
+
+	insecureTransport     *http.Transport
+	upstreamInsecureHosts []string
+	upstreamClientCerts   map[string]*tls.Certificate
+	upstreamCertificates  []tls.Certificate
+	keyLogWriter          io.Writer
+
+	parentTransports       sync.Map // parentTransportKey -> *http.Transport
+	parentProxyTLSConfig   *tls.Config
+	parentProxyServerNames map[string]string
+
+	socks5RequireAuth    bool
+	socks5UDPIdleTimeout time.Duration
+
+	servePAC      bool
+	pacProxyAddrs []string
+	pacBypass     []string // FindProxyForURL conditions
+
+	proxyProtocolTrusted []*net.IPNet
+	sendProxyProtocolTo  map[string]int
 }
 
 var _ http.Handler = &Proxy{}
@@ -137,14 +173,36 @@ func NewProxy(hconf *HandlerConfig, em *ExtensionManager) *Proxy {
 	}
 	p.delegate.SetExtensionManager(em)
 
-	p.cert = cert.NewCertificate(hconf.CertCache)
+	ca, err := hconf.LoadCA()
+	if err != nil {
+		panic(fmt.Errorf("Load MITM root CA failed: %s", err))
+	}
+	var certCache cert.Cache = hconf.CertCache
+	if certCache == nil {
+		certCache = cert.NewLRUCache(cert.DefaultCacheCapacity, cert.DefaultCacheTTL, cert.DefaultCacheRenewBefore)
+	}
+	p.certCache = certCache
+	if hconf.CertCacheDir != "" {
+		certCache, err = cert.NewDirCache(hconf.CertCacheDir, ca, cert.DefaultCacheRenewBefore, certCache)
+		if err != nil {
+			panic(fmt.Errorf("Open certificate cache directory %s failed: %s", hconf.CertCacheDir, err))
+		}
+	}
+	p.cert = cert.NewCertificate(ca, certCache, hconf.LeafOptions)
+	p.decryptHTTPS = hconf.DecryptHTTPS
+	p.mitmHosts = hconf.MITMHosts
+	p.mitmExcludeHosts = hconf.MITMExcludeHosts
+	if hconf.MITMFailureThreshold > 0 {
+		p.mitmBypass = NewMITMBypass(hconf.MITMFailureThreshold, hconf.MITMBypassTTL)
+	}
+	p.mirrorUpstreamCert = hconf.MirrorUpstreamCert
+	p.mitmIdleTimeout = hconf.MITMIdleTimeout
+	if p.mitmIdleTimeout <= 0 {
+		p.mitmIdleTimeout = defaultClientReadWriteTimeout
+	}
 
 	if hconf.Transport == nil {
 		p.transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				// No need to verify because as a proxy we don't care
-				InsecureSkipVerify: true,
-			},
 			DialContext: (&net.Dialer{
 				Timeout:   30 * time.Second,
 				KeepAlive: 30 * time.Second,
@@ -158,19 +216,60 @@ func NewProxy(hconf *HandlerConfig, em *ExtensionManager) *Proxy {
 			ProxyConnectHeader:    make(http.Header),
 		}
 	} else {
-		p.transport = hconf.Transport
+		// Clone it, the same Transport may be shared by several proxies.
+		p.transport = hconf.Transport.Clone()
 		p.transport.ProxyConnectHeader = make(http.Header)
 	}
 	p.transport.DisableKeepAlives = hconf.DisableKeepAlive
+	if !hconf.DisableMITMHTTP2 {
+		p.h2Server = &http2.Server{IdleTimeout: p.mitmIdleTimeout}
+		// Talk h2 to origins as well, gRPC does not work over HTTP/1.1.
+		p.transport.ForceAttemptHTTP2 = true
+	}
 	p.mode = hconf.Mode
 	if p.mode == ConnPoolMode {
 		p.transport.ProxyConnectHeader.Set("MITM", "Enabled")
 	}
+	p.keyLogWriter = hconf.KeyLogWriter
+	p.parentProxyTLSConfig = hconf.ParentProxyTLSConfig
+	p.parentProxyServerNames = hconf.ParentProxyServerNames
+	p.socks5RequireAuth = hconf.SOCKS5RequireAuth
+	p.socks5UDPIdleTimeout = hconf.SOCKS5UDPIdleTimeout
+	if p.socks5UDPIdleTimeout <= 0 {
+		p.socks5UDPIdleTimeout = defaultSOCKS5UDPIdleTimeout
+	}
+	p.servePAC = hconf.ServePAC
+	p.pacProxyAddrs = hconf.PACProxyAddrs
+	p.pacBypass = pacBypassConditions(hconf.PACBypass)
+	if err := p.setupUpstreamTLS(hconf); err != nil {
+		panic(fmt.Errorf("Load upstream CA bundles failed: %s", err))
+	}
+	trusted, err := parseCIDRs(hconf.ProxyProtocolTrustedCIDRs)
+	if err != nil {
+		panic(fmt.Errorf("Parse ProxyProtocolTrustedCIDRs failed: %s", err))
+	}
+	p.proxyProtocolTrusted = trusted
+	for addr, version := range hconf.SendProxyProtocol {
+		if version != 1 && version != 2 {
+			panic(fmt.Errorf("SendProxyProtocol %s: unsupported PROXY protocol version %d", addr, version))
+		}
+	}
+	p.sendProxyProtocolTo = hconf.SendProxyProtocol
 	return p
 }
 
 // ServeHTTP .
 func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if p.isPACRequest(req) {
+		p.writePAC(rw, req)
+		return
+	}
+	if req.URL.Host == "" && req.Method != http.MethodConnect {
+		// Requests without an absolute URL are sent to the proxy itself,
+		// proxying them to their Host would loop back here.
+		http.NotFound(rw, req)
+		return
+	}
 	if req.URL.Host == "" {
 		req.URL.Host = req.Host
 	}
@@ -187,6 +286,11 @@ func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		RespLength: 0,
 		Closed:     false,
 	}
+	if conn, ok := req.Context().Value(connContextKey{}).(net.Conn); ok {
+		ctx.ClientAddr, ctx.PeerAddr = clientAddrs(conn)
+	} else if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		ctx.ClientAddr, ctx.PeerAddr = addr, addr
+	}
 	defer p.delegate.Finish(ctx, rw)
 	p.delegate.Connect(ctx, rw)
 	if ctx.abort {
@@ -215,9 +319,10 @@ func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	switch p.mode {
 	case NormalMode:
 		if ctx.Req.Method == http.MethodConnect {
-			h := ctx.Req.Header.Get("MITM")
-			if h == "Enabled" {
-				ctx.MITM = true
+			// ctx.MITM holds what the configuration suggests, the Delegate has the final say.
+			ctx.MITM = p.mitmByConfig(ctx)
+			ctx.MITM = p.delegate.ShouldMITM(ctx)
+			if ctx.MITM {
 				if isWebSocketRequest(ctx.Req) {
 					p.proxyHTTPSWebsocket(ctx, rw)
 				} else {
@@ -242,6 +347,13 @@ func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// CertCache returns the in-memory cache of the MITM certificates, the
+// HandlerConfig's CertCache or the *cert.LRUCache created in its place,
+// whose Stats count the hits, misses and evictions.
+func (p *Proxy) CertCache() cert.Cache {
+	return p.certCache
+}
+
 // ClientConnNum gets the Client
 func (p *Proxy) ClientConnNum() int32 {
 	return atomic.LoadInt32(&p.clientConnNum)
@@ -274,7 +386,7 @@ func (p *Proxy) proxyHTTP(ctx *Context, rw http.ResponseWriter) {
 			Logger.Errorf("proxyHTTP %s forward request failed: %s", ctx.Req.URL, err)
 			rw.WriteHeader(http.StatusBadGateway)
 			WriteProxyErrorToResponseBody(ctx, rw, http.StatusBadGateway, fmt.Sprintf("proxyHTTP %s forward request failed: %s", ctx.Req.URL, err), "")
-			ctx.SetContextErrorWithType(err, HTTPDoRequestFail)
+			ctx.SetContextErrorWithType(err, upstreamErrType(err, HTTPDoRequestFail))
 			return
 		}
 
@@ -295,7 +407,7 @@ func (p *Proxy) proxyHTTP(ctx *Context, rw http.ResponseWriter) {
 }
 
 func (p *Proxy) proxyHTTPS(ctx *Context, rw http.ResponseWriter) {
-	tlsConfig, err := p.cert.GenerateTLSConfig(ctx.Req.URL.Host)
+	tlsConfig, err := p.mitmTLSConfig(ctx, HTTPSGenerateTLSConfigFail)
 	if err != nil {
 		Logger.Errorf("proxyHTTPS %s generate tlsConfig failed: %s", ctx.Req.URL.Host, err)
 		rw.WriteHeader(http.StatusBadGateway)
@@ -319,51 +431,158 @@ func (p *Proxy) proxyHTTPS(ctx *Context, rw http.ResponseWriter) {
 		ctx.SetContextErrorWithType(err, HTTPSWriteEstRespFail)
 		return
 	}
-	// tlsConfig.NextProtos = []string{"h2", "http/1.1", "http/1.0"}
+	p.serveMITM(ctx, rw, clientConn, tlsConfig)
+}
+
+// serveMITM decrypts the TLS connection clientConn, whose handshake has not begun yet,
+// and forwards the requests read from it.
+func (p *Proxy) serveMITM(ctx *Context, rw http.ResponseWriter, clientConn net.Conn, tlsConfig *tls.Config) {
+	if p.h2Server != nil {
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
 	tlsClientConn := tls.Server(clientConn, tlsConfig)
 	// tlsClientConn.SetDeadline(time.Now().Add(defaultClientReadWriteTimeout))
 	defer tlsClientConn.Close()
 	if err := tlsClientConn.Handshake(); err != nil {
-		Logger.Errorf("proxyHTTPS %s handshake failed: %s", ctx.Req.URL.Host, err)
-		ctx.SetContextErrorWithType(err, HTTPSTLSClientConnHandshakeFail)
+		Logger.Errorf("serveMITM %s handshake failed: %s", ctx.Req.URL.Host, err)
+		p.mitmHandshakeFailed(ctx, err, HTTPSTLSClientConnHandshakeFail, HTTPSGenerateTLSConfigFail)
+		return
+	}
+	p.mitmHandshakeSucceeded(ctx)
+	if tlsClientConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		p.serveMITMHTTP2(ctx, tlsClientConn)
 		return
 	}
+	// Serve requests until the client closes the connection or stays idle for too long.
+	// Each of them gets its own Context, whose Parent is the Context of the CONNECT.
 	buf := bufio.NewReader(tlsClientConn)
-	tlsReq, err := http.ReadRequest(buf)
-	if err != nil {
-		if err != io.EOF {
-			Logger.Errorf("proxyHTTPS %s read client request failed: %s", ctx.Req.URL.Host, err)
-			ctx.SetContextErrorWithType(err, HTTPSReadReqFromBufFail)
+	for {
+		tlsClientConn.SetReadDeadline(time.Now().Add(p.mitmIdleTimeout))
+		tlsReq, err := http.ReadRequest(buf)
+		if err != nil {
+			if err != io.EOF && !isTimeout(err) {
+				Logger.Errorf("serveMITM %s read client request failed: %s", ctx.Req.URL.Host, err)
+				ctx.SetContextErrorWithType(err, HTTPSReadReqFromBufFail)
+			}
+			return
+		}
+		tlsClientConn.SetReadDeadline(time.Time{})
+		tlsReq.RemoteAddr = ctx.Req.RemoteAddr
+		tlsReq.URL.Scheme = "https"
+		tlsReq.URL.Host = tlsReq.Host
+
+		// The transport may read or close the body after the response came,
+		// concurrently with the next ReadRequest on buf. It gets a body it
+		// cannot close, which is drained and closed here before reading on.
+		body := tlsReq.Body
+		if body != http.NoBody {
+			tlsReq.Body = ioutil.NopCloser(body)
+		}
+
+		reqCtx := newChildContext(ctx, tlsReq)
+		keepAlive := p.serveMITMRequest(reqCtx, rw, tlsClientConn)
+		ctx.ReqLength += reqCtx.ReqLength
+		ctx.RespLength += reqCtx.RespLength
+		if !drainBody(body) || !keepAlive {
+			return
 		}
-		return
 	}
-	tlsReq.RemoteAddr = ctx.Req.RemoteAddr
-	tlsReq.URL.Scheme = "https"
-	tlsReq.URL.Host = tlsReq.Host
+}
 
-	ctx.Req = tlsReq
+// drainBody discards what is left of body, up to maxDrainBodyBytes, and closes it.
+// It reports whether body was read to its end.
+func drainBody(body io.ReadCloser) bool {
+	_, err := io.CopyN(ioutil.Discard, body, maxDrainBodyBytes+1)
+	body.Close()
+	return err == io.EOF
+}
+
+// serveMITMRequest forwards one request read from a MITM'd connection
+// and reports whether the connection can serve another one.
+func (p *Proxy) serveMITMRequest(ctx *Context, rw http.ResponseWriter, tlsClientConn *tls.Conn) (keepAlive bool) {
+	defer p.delegate.Finish(ctx, rw)
 	p.DoRequest(ctx, rw, func(resp *http.Response, err error) {
 		if err != nil {
 			Logger.Errorf("proxyHTTPS %s forward request failed: %s", ctx.Req.URL.Host, err)
 			WriteProxyErrorToResponseBody(ctx, tlsClientConn, http.StatusBadGateway, fmt.Sprintf("proxyHTTPS %s forward request failed: %s", ctx.Req.URL.Host, err), badGateway)
-			ctx.SetContextErrorWithType(err, HTTPSDoRequestFail)
+			ctx.SetContextErrorWithType(err, upstreamErrType(err, HTTPSDoRequestFail))
 			return
 		}
 		defer resp.Body.Close()
 		p.delegate.DuringResponse(ctx, resp) // resp could be closed in this method
 
+		// The upstream may have answered over HTTP/2, while this client speaks HTTP/1.x.
+		if resp.ProtoMajor != 1 {
+			resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+		}
+		if resp.ContentLength < 0 && !isChunked(resp.TransferEncoding) && ctx.Req.ProtoAtLeast(1, 1) {
+			resp.TransferEncoding = []string{"chunked"}
+		}
 		lengthWriter := &WriterWithLength{tlsClientConn, 1, 0}
 		err = resp.Write(lengthWriter)
+		ctx.RespLength += int64(lengthWriter.Length())
 		if err != nil {
 			Logger.Errorf("proxyHTTPS %s write response to client connection failed: %s", ctx.Req.URL.Host, err)
 			ctx.SetContextErrorWithType(err, HTTPSWriteRespFail)
+			return
 		}
-		ctx.RespLength += int64(lengthWriter.Length())
+		// Without a length the end of the body is marked by closing the connection.
+		keepAlive = !ctx.Req.Close && !resp.Close && (resp.ContentLength >= 0 || isChunked(resp.TransferEncoding))
 	}, tlsClientConn)
+	return keepAlive && !ctx.abort
+}
+
+// serveMITMHTTP2 serves a MITM'd connection that negotiated h2 with the client.
+// Every stream is forwarded as its own request with a Context whose Parent is ctx.
+func (p *Proxy) serveMITMHTTP2(ctx *Context, tlsClientConn *tls.Conn) {
+	p.h2Server.ServeConn(tlsClientConn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			req.RemoteAddr = ctx.Req.RemoteAddr
+			req.URL.Scheme = "https"
+			req.URL.Host = req.Host
+
+			reqCtx := newChildContext(ctx, req)
+			// Streams are answered through rw, writing to the connection would break the h2 framing.
+			reqCtx.Hijack = false
+			defer func() {
+				// Streams run concurrently.
+				ctx.Lock.Lock()
+				ctx.ReqLength += reqCtx.ReqLength
+				ctx.RespLength += reqCtx.RespLength
+				ctx.Lock.Unlock()
+			}()
+			defer p.delegate.Finish(reqCtx, rw)
+			p.DoRequest(reqCtx, rw, func(resp *http.Response, err error) {
+				if err != nil {
+					Logger.Errorf("proxyHTTPS %s forward h2 request failed: %s", reqCtx.Req.URL.Host, err)
+					rw.WriteHeader(http.StatusBadGateway)
+					WriteProxyErrorToResponseBody(reqCtx, rw, http.StatusBadGateway, fmt.Sprintf("proxyHTTPS %s forward h2 request failed: %s", reqCtx.Req.URL.Host, err), "")
+					reqCtx.SetContextErrorWithType(err, upstreamErrType(err, HTTPSDoRequestFail))
+					return
+				}
+				defer resp.Body.Close()
+				p.delegate.DuringResponse(reqCtx, resp) // resp could be closed in this method
+
+				CopyHeader(rw.Header(), resp.Header)
+				rw.WriteHeader(resp.StatusCode)
+				written, err := io.Copy(&flushWriter{rw}, resp.Body)
+				reqCtx.RespLength += written
+				if err != nil {
+					Logger.Errorf("proxyHTTPS %s write h2 response failed: %s", reqCtx.Req.URL.Host, err)
+					reqCtx.SetContextErrorWithType(err, HTTPSWriteRespFail)
+					return
+				}
+				// Trailers are only known after the body has been read, e.g. grpc-status.
+				for k, vv := range resp.Trailer {
+					rw.Header()[http.TrailerPrefix+k] = vv
+				}
+			})
+		}),
+	})
 }
 
 func (p *Proxy) proxyTunnel(ctx *Context, rw http.ResponseWriter) {
-	parentProxyURL, err := p.delegate.ParentProxy(ctx, rw)
+	parentProxies, err := p.parentProxies(ctx, rw)
 	if ctx.abort {
 		ctx.SetContextErrType(ParentProxyFail)
 		return
@@ -388,11 +607,23 @@ func (p *Proxy) proxyTunnel(ctx *Context, rw http.ResponseWriter) {
 	// defer clientConn.Close()
 
 	targetAddr := ctx.Req.URL.Host
-	if parentProxyURL != nil {
-		targetAddr = parentProxyURL.Host
-	}
-
-	targetConn, err := net.DialTimeout("tcp", targetAddr, defaultTargetConnectTimeout)
+	// A single HTTP or HTTPS parent answers the CONNECT of the client itself,
+	// longer chains and SOCKS5 parents are tunneled through by the proxy.
+	var parentProxyURL *url.URL
+	var targetConn net.Conn
+	err = p.withParentFallbacks(ctx, parentProxies, func(parentProxies []*url.URL) error {
+		var err error
+		parentProxyURL = nil
+		if len(parentProxies) == 1 && !isSOCKS5(parentProxies[0]) {
+			parentProxyURL = parentProxies[0]
+			targetConn, err = p.dialParent(parentProxyURL, ctx.ClientAddr)
+		} else if len(parentProxies) > 0 {
+			targetConn, err = p.dialParentTunnel(parentProxies, targetAddr, ctx.ClientAddr)
+		} else {
+			targetConn, err = p.dialTarget(targetAddr, ctx.ClientAddr)
+		}
+		return err
+	})
 
 	connWrapper := &ConnWrapper{
 		Conn: targetConn,
@@ -406,7 +637,7 @@ func (p *Proxy) proxyTunnel(ctx *Context, rw http.ResponseWriter) {
 	if err != nil {
 		Logger.Errorf("proxyTunnel %s dial remote server failed: %s", ctx.Req.URL.Host, err)
 		WriteProxyErrorToResponseBody(ctx, clientConn, http.StatusBadGateway, fmt.Sprintf("proxyTunnel %s dial remote server failed: %s", ctx.Req.URL.Host, err), badGateway)
-		ctx.SetContextErrorWithType(err, TunnelDialRemoteServerFail)
+		ctx.SetContextErrorWithType(err, upstreamErrType(err, TunnelDialRemoteServerFail))
 		return
 	}
 	// defer targetConn.Close()
@@ -508,14 +739,17 @@ func (p *Proxy) DoRequest(ctx *Context, rw http.ResponseWriter, responseFunc fun
 	removeMITMHeaders(newReq.Header)
 	removeConnectionHeaders(newReq.Header)
 	removeHopHeaders(newReq.Header)
+	// "TE: trailers" is the only TE value that may be forwarded, and gRPC requires it.
+	if headerContains(ctx.Req.Header, "Te", "trailers") {
+		newReq.Header.Set("Te", "trailers")
+	}
 
-	// p.transport.ForceAttemptHTTP2 = true // for HTTP/2 test
-	var parentProxyURL *url.URL
+	var parentProxies []*url.URL
 	var err error
 	if ctx.Hijack {
-		parentProxyURL, err = p.delegate.ParentProxy(ctx, clientConn)
+		parentProxies, err = p.parentProxies(ctx, clientConn)
 	} else {
-		parentProxyURL, err = p.delegate.ParentProxy(ctx, rw)
+		parentProxies, err = p.parentProxies(ctx, rw)
 	}
 	if ctx.abort {
 		ctx.SetContextErrType(ParentProxyFail)
@@ -524,8 +758,13 @@ func (p *Proxy) DoRequest(ctx *Context, rw http.ResponseWriter, responseFunc fun
 
 	type CtxKey int
 	var pkey CtxKey = 0
-	fakeCtx := context.WithValue(newReq.Context(), pkey, parentProxyURL)
-	newReq = newReq.Clone(fakeCtx)
+	handshake := &upstreamHandshake{host: newReq.URL.Hostname()}
+	// The transport closes the body when a parent proxy cannot be connected to,
+	// the fallbacks still have to send it.
+	if body := newReq.Body; body != nil && len(ctx.ParentProxyFallbacks) > 0 {
+		newReq.Body = ioutil.NopCloser(body)
+		defer body.Close()
+	}
 
 	ctx.ReqLength += newReq.ContentLength
 	// dump, dumperr := httputil.DumpRequestOut(newReq, true)
@@ -535,27 +774,38 @@ func (p *Proxy) DoRequest(ctx *Context, rw http.ResponseWriter, responseFunc fun
 	// 	ctx.ReqLength += int64(len(dump))
 	// }
 
-	tr := p.transport
-	tr.Proxy = func(req *http.Request) (*url.URL, error) {
-		ctx := req.Context()
-		pURL := ctx.Value(pkey).(*url.URL)
-		// req = req.Clone(context.Background())
-		trace := &httptrace.ClientTrace{
-			GotConn: func(connInfo httptrace.GotConnInfo) {
-				Logger.Infof("Got conn: %+v", connInfo)
-			},
-			DNSDone: func(dnsInfo httptrace.DNSDoneInfo) {
-				Logger.Infof("DNS done, info: %+v", dnsInfo)
-			},
-			GotFirstResponseByte: func() {
-				Logger.Infof("GotFirstResponseByte: %+v", time.Now())
-			},
+	var resp *http.Response
+	err = p.withParentFallbacks(ctx, parentProxies, func(parentProxies []*url.URL) error {
+		fakeCtx := context.WithValue(newReq.Context(), pkey, transportProxyURL(parentProxies, newReq.URL.Scheme))
+		req := newReq.Clone(handshake.context(fakeCtx))
+		tr := p.parentTransport(p.transportFor(req.URL.Host), parentProxies, req.URL.Scheme)
+		tr.Proxy = func(req *http.Request) (*url.URL, error) {
+			ctx := req.Context()
+			pURL := ctx.Value(pkey).(*url.URL)
+			if pURL == nil {
+				// Direct, or dialed through the chain by the transport of parentTransport.
+				return nil, nil
+			}
+			// req = req.Clone(context.Background())
+			trace := &httptrace.ClientTrace{
+				GotConn: func(connInfo httptrace.GotConnInfo) {
+					Logger.Infof("Got conn: %+v", connInfo)
+				},
+				DNSDone: func(dnsInfo httptrace.DNSDoneInfo) {
+					Logger.Infof("DNS done, info: %+v", dnsInfo)
+				},
+				GotFirstResponseByte: func() {
+					Logger.Infof("GotFirstResponseByte: %+v", time.Now())
+				},
+			}
+			req = req.Clone(httptrace.WithClientTrace(context.Background(), trace))
+			return pURL, err
 		}
-		req = req.Clone(httptrace.WithClientTrace(context.Background(), trace))
-		return pURL, err
-	}
 
-	resp, err := tr.RoundTrip(newReq)
+		var err error
+		resp, err = tr.RoundTrip(req)
+		return handshake.result(err)
+	})
 
 	respWrapper := &ResponseWrapper{
 		Resp: resp,
@@ -574,6 +824,22 @@ func (p *Proxy) DoRequest(ctx *Context, rw http.ResponseWriter, responseFunc fun
 	responseFunc(resp, err)
 }
 
+// isChunked checks whether the transfer encodings include chunked.
+func isChunked(te []string) bool {
+	for _, v := range te {
+		if strings.EqualFold(v, "chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+// isTimeout checks whether err is a net.Error caused by a timeout.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
 // hijacker gets the underlying connection of an http.ResponseWriter
 func hijacker(rw http.ResponseWriter) (net.Conn, error) {
 	hijacker, ok := rw.(http.Hijacker)
@@ -710,7 +976,8 @@ func (p *Proxy) proxyHTTPWithConnPool(ctx *Context, rw http.ResponseWriter) {
 
 		type CtxKey int
 		var pkey CtxKey = 0
-		fakeCtx := context.WithValue(newReq.Context(), pkey, parentProxyURL)
+		parentProxies := []*url.URL{parentProxyURL}
+		fakeCtx := context.WithValue(newReq.Context(), pkey, transportProxyURL(parentProxies, newReq.URL.Scheme))
 		newReq = newReq.Clone(fakeCtx)
 
 		ctx.ReqLength += newReq.ContentLength
@@ -721,10 +988,14 @@ func (p *Proxy) proxyHTTPWithConnPool(ctx *Context, rw http.ResponseWriter) {
 		// 	ctx.ReqLength += int64(len(dump))
 		// }
 
-		tr := p.transport
+		tr := p.parentTransport(p.transport, parentProxies, newReq.URL.Scheme)
 		tr.Proxy = func(req *http.Request) (*url.URL, error) {
 			ctx := req.Context()
 			pURL := ctx.Value(pkey).(*url.URL)
+			if pURL == nil {
+				// Dialed through the parent by the transport of parentTransport.
+				return nil, nil
+			}
 			// req = req.Clone(context.Background())
 			trace := &httptrace.ClientTrace{
 				GotConn: func(connInfo httptrace.GotConnInfo) {
@@ -755,7 +1026,7 @@ func (p *Proxy) proxyHTTPWithConnPool(ctx *Context, rw http.ResponseWriter) {
 
 		if err != nil {
 			Logger.Errorf("proxyHTTPWithConnPool %s RoundTrip failed: %s", ctx.Req.URL, err)
-			ctx.SetPoolContextErrorWithType(err, PoolRoundTripFail, proxyTag)
+			ctx.SetPoolContextErrorWithType(err, upstreamErrType(err, PoolRoundTripFail), proxyTag)
 			continue
 		}
 		removeConnectionHeaders(resp.Header)
@@ -853,42 +1124,32 @@ func (p *Proxy) proxyTunnelWithConnPool(ctx *Context, rw http.ResponseWriter) {
 		ctx.SetPoolContextErrorWithType(err, PoolGetConnPoolFail)
 		return
 	}
-	work := false
 
-	for range poolChoices {
-		choice, err := randutil.WeightedChoice(poolChoices)
-		pool := choice.Item.(ConnPool)
-		parentProxyURL := pool.GetRemoteAddrURL()
+	err = p.tunnelWithConnPools(ctx, clientConn, poolChoices, func(pool ConnPool, parentProxyURL *url.URL, targetConn net.Conn) bool {
 		proxyTag := pool.GetTag()
-		for i := range poolChoices {
-			pl := poolChoices[i].Item.(ConnPool)
-			if pl.GetTag() == proxyTag {
-				poolChoices[i].Weight = 0
-				break
+		var err error
+		if isSOCKS5(parentProxyURL) {
+			err = socks5Connect(context.Background(), targetConn, parentProxyURL, ctx.Req.URL.Host)
+			p.delegate.DuringResponse(ctx, &TunnelInfo{Client: clientConn, Target: targetConn, Err: err, ParentProxy: parentProxyURL, Pool: pool}) // targetConn could be closed in this method
+			if err != nil {
+				Logger.Errorf("proxyTunnelWithConnPool %s socks5 connect through %s(%s) failed: %s", ctx.Req.URL.Host, parentProxyURL.Host, proxyTag, err)
+				ctx.SetPoolContextErrorWithType(err, upstreamErrType(err, PoolWriteTargetConnFail), proxyTag)
+				targetConn.Close()
+				return false
 			}
+			m, err := clientConn.Write(tunnelEstablishedResponseLine)
+			ctx.RespLength += int64(m)
+			if err != nil {
+				Logger.Errorf("proxyTunnelWithConnPool %s write message failed: %s", ctx.Req.URL.Host, err)
+				ctx.SetPoolContextErrorWithType(err, PoolWriteClientFail, proxyTag)
+				targetConn.Close()
+				return true
+			}
+			transfer(ctx, clientConn, targetConn, proxyTag)
+			targetConn.Close()
+			return true
 		}
 
-		// targetConn, err := net.DialTimeout("tcp", parentProxyURL.Host, defaultTargetConnectTimeout)
-		targetConn, err := pool.GetWithTimeout(defaultTargetConnectTimeout)
-
-		p.delegate.BeforeResponse(ctx, &TunnelInfo{
-			Client:      clientConn,
-			Target:      targetConn,
-			Err:         err,
-			ParentProxy: parentProxyURL,
-			Pool:        pool,
-		})
-		if ctx.abort {
-			ctx.SetPoolContextErrorWithType(nil, BeforeRequestFail)
-			return
-		}
-		if err != nil {
-			Logger.Errorf("proxyTunnelWithConnPool %s get connection to %s(%s) failed: %s", ctx.Req.URL.Host, parentProxyURL.Host, proxyTag, err)
-			ctx.SetPoolContextErrorWithType(err, PoolGetConnFail, proxyTag)
-			continue
-		}
-		// defer targetConn.Close is not used as it's in a loop
-
 		err = makeTunnelRequestWithAuth(ctx, parentProxyURL, targetConn)
 
 		p.delegate.DuringResponse(ctx, &TunnelInfo{Client: clientConn, Target: targetConn, Err: err, ParentProxy: parentProxyURL, Pool: pool}) // targetConn could be closed in this method
@@ -896,7 +1157,7 @@ func (p *Proxy) proxyTunnelWithConnPool(ctx *Context, rw http.ResponseWriter) {
 			Logger.Errorf("proxyTunnelWithConnPool %s make connect request to %s(%s) failed: %s", ctx.Req.URL.Host, parentProxyURL.Host, proxyTag, err)
 			ctx.SetPoolContextErrorWithType(err, PoolWriteTargetConnFail, proxyTag)
 			targetConn.Close()
-			continue
+			return false
 		}
 
 		connectResult := make([]byte, defaultHTTPResponsePeekSize) // buffer for http response header and body
@@ -907,13 +1168,12 @@ func (p *Proxy) proxyTunnelWithConnPool(ctx *Context, rw http.ResponseWriter) {
 			Logger.Errorf("proxyTunnelWithConnPool %s read error: %s", ctx.Req.URL.Host, err)
 			ctx.SetPoolContextErrorWithType(err, PoolReadTargetFail, proxyTag)
 			targetConn.Close()
-			continue
+			return false
 		}
 
 		// "HTTP/X.X 200 OK" takes 15 bytes
 		if string(connectResult[8:13]) != " 429 " {
 			if string(connectResult[8:15]) == " 200 OK" || !strings.Contains(string(connectResult), internalErr) {
-				work = true
 				m, err := clientConn.Write(connectResult[:n])
 				ctx.RespLength += int64(m)
 				if err != nil || n != m {
@@ -925,11 +1185,11 @@ func (p *Proxy) proxyTunnelWithConnPool(ctx *Context, rw http.ResponseWriter) {
 						ctx.SetPoolContextErrorWithType(fmt.Errorf("proxyTunnelWithConnPool %s partial write, read: %d, write: %d", ctx.Req.URL.Host, n, m), PoolWriteClientFail, proxyTag)
 					}
 					targetConn.Close()
-					break
+					return true
 				}
 				transfer(ctx, clientConn, targetConn, proxyTag)
 				targetConn.Close()
-				break
+				return true
 			}
 		}
 		// Retry
@@ -946,8 +1206,13 @@ func (p *Proxy) proxyTunnelWithConnPool(ctx *Context, rw http.ResponseWriter) {
 			}
 		}
 		targetConn.Close()
+		return false
+	})
+	if err == errTunnelAborted {
+		ctx.SetPoolContextErrorWithType(nil, BeforeRequestFail)
+		return
 	}
-	if !work {
+	if err != nil {
 		// No parentProxyURL works, just return http.StatusTooManyRequests
 		Logger.Errorf("proxyTunnelWithConnPool %s cannot find working parent proxy to forward request", ctx.Req.URL.Host)
 		WriteProxyErrorToResponseBody(ctx, clientConn, http.StatusTooManyRequests, fmt.Sprintf("proxyTunnelWithConnPool %s cannot find working parent proxy to forward request", ctx.Req.URL.Host), tooManyRequests)
@@ -955,6 +1220,66 @@ func (p *Proxy) proxyTunnelWithConnPool(ctx *Context, rw http.ResponseWriter) {
 	}
 }
 
+// errNoParentProxy is returned by tunnelWithConnPools when no ConnPool works.
+var errNoParentProxy = errors.New("no available parent proxy")
+
+// tunnelWithConnPools gets a connection to a parent proxy from each ConnPool of
+// poolChoices, in weighted random order, until tunnel makes the tunnel with it
+// and returns true. tunnel closes targetConn. The Delegate sees every connection
+// in BeforeResponse, errTunnelAborted is returned if it aborts.
+func (p *Proxy) tunnelWithConnPools(ctx *Context, clientConn net.Conn, poolChoices []randutil.Choice, tunnel func(pool ConnPool, parentProxyURL *url.URL, targetConn net.Conn) bool) error {
+	for range poolChoices {
+		choice, err := randutil.WeightedChoice(poolChoices)
+		if err != nil {
+			break
+		}
+		pool := choice.Item.(ConnPool)
+		parentProxyURL := pool.GetRemoteAddrURL()
+		proxyTag := pool.GetTag()
+		for i := range poolChoices {
+			pl := poolChoices[i].Item.(ConnPool)
+			if pl.GetTag() == proxyTag {
+				poolChoices[i].Weight = 0
+				break
+			}
+		}
+
+		targetConn, err := pool.GetWithTimeout(defaultTargetConnectTimeout)
+		if err == nil {
+			err = p.sendProxyProtocol(targetConn, withDefaultPort(parentProxyURL.Host, parentProxyURL.Scheme), ctx.ClientAddr, targetConn.RemoteAddr())
+		}
+		if err == nil && isHTTPSProxy(parentProxyURL) {
+			handshakeCtx, cancel := context.WithTimeout(context.Background(), defaultTargetConnectTimeout)
+			targetConn, err = p.parentTLSClient(handshakeCtx, targetConn, parentProxyURL)
+			cancel()
+		}
+
+		p.delegate.BeforeResponse(ctx, &TunnelInfo{
+			Client:      clientConn,
+			Target:      targetConn,
+			Err:         err,
+			ParentProxy: parentProxyURL,
+			Pool:        pool,
+		})
+		if ctx.abort {
+			if targetConn != nil {
+				targetConn.Close()
+			}
+			return errTunnelAborted
+		}
+		if err != nil {
+			Logger.Errorf("tunnelWithConnPools %s get connection to %s(%s) failed: %s", ctx.Req.URL.Host, parentProxyURL.Host, proxyTag, err)
+			ctx.SetPoolContextErrorWithType(err, PoolGetConnFail, proxyTag)
+			continue
+		}
+		// defer targetConn.Close is not used as it's in a loop
+		if tunnel(pool, parentProxyURL, targetConn) {
+			return nil
+		}
+	}
+	return errNoParentProxy
+}
+
 func headerContains(header http.Header, name string, value string) bool {
 	for _, v := range header[name] {
 		for _, s := range strings.Split(v, ",") {
@@ -1000,7 +1325,7 @@ func (p *Proxy) websocketHandshake(ctx *Context, req *http.Request, targetConn i
 }
 
 func (p *Proxy) serveWebsocket(ctx *Context, rw http.ResponseWriter, req *http.Request) {
-	parentProxyURL, err := p.delegate.ParentProxy(ctx, rw)
+	parentProxies, err := p.parentProxies(ctx, rw)
 	if ctx.abort {
 		ctx.SetContextErrType(ParentProxyFail)
 		return
@@ -1010,15 +1335,22 @@ func (p *Proxy) serveWebsocket(ctx *Context, rw http.ResponseWriter, req *http.R
 	// targetURL := url.URL{Scheme: "ws", Host: req.URL.Host, Path: req.URL.Path}
 
 	targetAddr := ctx.Req.URL.Host
-	if parentProxyURL != nil {
-		targetAddr = parentProxyURL.Host
-	}
-
-	targetConn, err := net.DialTimeout("tcp", targetAddr, defaultTargetConnectTimeout)
+	var targetConn net.Conn
+	err = p.withParentFallbacks(ctx, parentProxies, func(parentProxies []*url.URL) error {
+		var err error
+		if len(parentProxies) == 1 && !isSOCKS5(parentProxies[0]) {
+			targetConn, err = p.dialParent(parentProxies[0], ctx.ClientAddr)
+		} else if len(parentProxies) > 0 {
+			targetConn, err = p.dialParentTunnel(parentProxies, withDefaultPort(ctx.Req.URL.Host, "ws"), ctx.ClientAddr)
+		} else {
+			targetConn, err = p.dialTarget(targetAddr, ctx.ClientAddr)
+		}
+		return err
+	})
 	if err != nil {
 		Logger.Errorf("serveWebsocket %s dial targetURL failed: %s", ctx.Req.URL, err)
 		rw.WriteHeader(http.StatusBadGateway)
-		ctx.SetContextErrorWithType(err, HTTPWebsocketDailFail)
+		ctx.SetContextErrorWithType(err, upstreamErrType(err, HTTPWebsocketDailFail))
 		return
 	}
 	defer targetConn.Close()
@@ -1051,13 +1383,13 @@ func (p *Proxy) serveWebsocket(ctx *Context, rw http.ResponseWriter, req *http.R
 
 // TODO: should remove some headers before sending it to remote server or proxy
 func (p *Proxy) serveWebsocketTLS(ctx *Context, rw http.ResponseWriter, req *http.Request) {
-	parentProxyURL, err := p.delegate.ParentProxy(ctx, rw)
+	parentProxies, err := p.parentProxies(ctx, rw)
 	if ctx.abort {
 		ctx.SetContextErrType(ParentProxyFail)
 		return
 	}
 
-	tlsConfig, err := p.cert.GenerateTLSConfig(ctx.Req.URL.Host)
+	tlsConfig, err := p.mitmTLSConfig(ctx, HTTPSWebsocketGenerateTLSConfigFail)
 	if err != nil {
 		Logger.Errorf("serveWebsocketTLS %s generate tlsConfig failed: %s", ctx.Req.URL.Host, err)
 		rw.WriteHeader(http.StatusBadGateway)
@@ -1088,9 +1420,10 @@ func (p *Proxy) serveWebsocketTLS(ctx *Context, rw http.ResponseWriter, req *htt
 	// Normal https handshake
 	if err := tlsClientConn.Handshake(); err != nil {
 		Logger.Errorf("serveWebsocketTLS %s handshake failed: %s", ctx.Req.URL.Host, err)
-		ctx.SetContextErrorWithType(err, HTTPSWebsocketTLSClientConnHandshakeFail)
+		p.mitmHandshakeFailed(ctx, err, HTTPSWebsocketTLSClientConnHandshakeFail, HTTPSWebsocketGenerateTLSConfigFail)
 		return
 	}
+	p.mitmHandshakeSucceeded(ctx)
 
 	// After https handshake, read the client's request
 	buf := bufio.NewReader(tlsClientConn)
@@ -1103,22 +1436,25 @@ func (p *Proxy) serveWebsocketTLS(ctx *Context, rw http.ResponseWriter, req *htt
 		return
 	}
 
-	// Dail the remote server, could be another proxy
-	dialAddr := wsReq.URL.Host
-	if parentProxyURL != nil {
-		dialAddr = parentProxyURL.Host
-	}
+	// Dail the remote server, through the parent proxy if there is one.
+	// The request is in origin-form, the CONNECT authority is the address to dial.
+	dialAddr := ctx.Req.URL.Host
 
-	dialer := &net.Dialer{
-		Timeout: defaultTargetConnectTimeout,
+	conn, err := p.dialTunnel(ctx, parentProxies, dialAddr)
+	var targetConn *tls.Conn
+	if err == nil {
+		targetConn = tls.Client(conn, p.upstreamTLSConfig(wsReq.Host))
+		if err = handshakeUpstream(targetConn, (&url.URL{Host: wsReq.Host}).Hostname()); err != nil {
+			conn.Close()
+		}
 	}
-	tlsConfig.InsecureSkipVerify = true
-	targetConn, err := tls.DialWithDialer(dialer, "tcp", dialAddr, tlsConfig)
 	// targetConn, err := tls.Dial("tcp", dialAddr, tlsConfig)
 	if err != nil {
 		Logger.Errorf("serveWebsocket %s dial targetURL failed: %s", ctx.Req.URL, err)
-		rw.WriteHeader(http.StatusBadGateway)
-		ctx.SetContextErrorWithType(err, HTTPSWebsocketDailFail)
+		if upstreamErrType(err, HTTPSWebsocketDailFail) != HTTPSWebsocketDailFail {
+			WriteProxyErrorToResponseBody(ctx, tlsClientConn, http.StatusBadGateway, fmt.Sprintf("serveWebsocketTLS %s dial targetURL failed: %s", ctx.Req.URL.Host, err), badGateway)
+		}
+		ctx.SetContextErrorWithType(err, upstreamErrType(err, HTTPSWebsocketDailFail))
 		return
 	}
 	defer targetConn.Close()
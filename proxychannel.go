@@ -19,6 +19,9 @@ import (
 type Proxychannel struct {
 	extensionManager *ExtensionManager
 	server           *http.Server
+	socks5Addr       string
+	transparentAddr  string
+	tproxy           bool
 	waitGroup        *sync.WaitGroup
 	serverDone       chan bool
 }
@@ -27,6 +30,9 @@ type Proxychannel struct {
 func NewProxychannel(hconf *HandlerConfig, sconf *ServerConfig, m map[string]Extension) *Proxychannel {
 	pc := &Proxychannel{
 		extensionManager: NewExtensionManager(m),
+		socks5Addr:       sconf.SOCKS5Addr,
+		transparentAddr:  sconf.TransparentAddr,
+		tproxy:           sconf.TransparentTPROXY,
 		waitGroup:        &sync.WaitGroup{},
 		serverDone:       make(chan bool),
 	}
@@ -38,16 +44,27 @@ func NewProxychannel(hconf *HandlerConfig, sconf *ServerConfig, m map[string]Ext
 func NewServer(hconf *HandlerConfig, sconf *ServerConfig, em *ExtensionManager) *http.Server {
 	// handler := NewProxy(WithoutDecryptHTTPS())
 	handler := NewProxy(hconf, em)
+	if len(handler.pacProxyAddrs) == 0 {
+		handler.pacProxyAddrs = []string{sconf.ProxyAddr}
+	}
 	server := &http.Server{
 		Addr:         sconf.ProxyAddr,
 		Handler:      handler,
 		ReadTimeout:  sconf.ReadTimeout,
 		WriteTimeout: sconf.WriteTimeout,
 		TLSConfig:    sconf.TLSConfig,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
 	}
 	return server
 }
 
+// Proxy returns the handler of the HTTP server.
+func (pc *Proxychannel) Proxy() *Proxy {
+	return pc.server.Handler.(*Proxy)
+}
+
 func (pc *Proxychannel) runExtensionManager() {
 	defer pc.waitGroup.Done()
 	go pc.extensionManager.Setup() // TODO: modify setup and error handling
@@ -90,12 +107,49 @@ func (pc *Proxychannel) runServer() {
 	}
 
 	// Run server
+	addr := pc.server.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	httpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		Logger.Errorf("HTTP server Listen: %v", err)
+		os.Exit(1)
+	}
 	go func() {
-		if err := pc.server.ListenAndServe(); err != http.ErrServerClosed {
-			Logger.Errorf("HTTP server ListenAndServe: %v", err)
+		if err := pc.server.Serve(pc.Proxy().ProxyProtocolListener(httpListener)); err != http.ErrServerClosed {
+			Logger.Errorf("HTTP server Serve: %v", err)
 			os.Exit(1)
 		}
 	}()
+	if pc.socks5Addr != "" {
+		l, err := net.Listen("tcp", pc.socks5Addr)
+		if err != nil {
+			Logger.Errorf("SOCKS5 server Listen: %v", err)
+			os.Exit(1)
+		}
+		defer l.Close()
+		go func() {
+			if err := pc.Proxy().ServeSOCKS5(pc.Proxy().ProxyProtocolListener(l)); err != nil {
+				Logger.Errorf("SOCKS5 server Serve: %v", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	if pc.transparentAddr != "" {
+		l, err := ListenTransparent(pc.transparentAddr, pc.tproxy)
+		if err != nil {
+			Logger.Errorf("Transparent server Listen: %v", err)
+			os.Exit(1)
+		}
+		defer l.Close()
+		go func() {
+			if err := pc.Proxy().ServeTransparent(l); err != nil {
+				Logger.Errorf("Transparent server Serve: %v", err)
+				os.Exit(1)
+			}
+		}()
+	}
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(
@@ -0,0 +1,350 @@
+package proxychannel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolV2Sig starts the binary PROXY protocol v2 header, "PROXY " the v1 one.
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolV1MaxLen is the longest v1 header, CRLF included.
+const proxyProtocolV1MaxLen = 107
+
+// connContextKey is the key of the client connection in the context of the
+// requests served by NewServer.
+type connContextKey struct{}
+
+// ProxyProtocolListener returns a listener whose connections from the sources in
+// ProxyProtocolTrustedCIDRs must start with a PROXY protocol v1 or v2 header,
+// and have the client address it holds as RemoteAddr. Connections from other
+// sources are served as is. l itself is returned when no source is trusted.
+// A missing or invalid header closes the connection, after the Delegate's
+// Finish saw it with the PROXY_PROTOCOL_FAIL ErrType.
+func (p *Proxy) ProxyProtocolListener(l net.Listener) net.Listener {
+	if len(p.proxyProtocolTrusted) == 0 {
+		return l
+	}
+	return &proxyProtocolListener{Listener: l, p: p}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	p *Proxy
+}
+
+// Accept .
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !l.p.proxyProtocolTrustedIP(addr.IP) {
+		return conn, nil
+	}
+	// The header is read by the goroutine serving the connection, not to block Accept.
+	return &proxyProtocolConn{Conn: conn, p: l.p, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolTrustedIP checks whether ip may send PROXY protocol headers.
+func (p *Proxy) proxyProtocolTrustedIP(ip net.IP) bool {
+	for _, n := range p.proxyProtocolTrusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConn is a connection from a load balancer, which starts with
+// a PROXY protocol header that is read on first use.
+type proxyProtocolConn struct {
+	net.Conn
+	p *Proxy
+	r *bufio.Reader
+
+	once   sync.Once
+	err    error
+	client net.Addr // from the header, nil if it has none
+
+	lock         sync.Mutex
+	readDeadline time.Time // set by the user of the connection
+}
+
+// readHeader reads the PROXY protocol header once, within the read deadline of
+// the connection if one was set already.
+func (c *proxyProtocolConn) readHeader() error {
+	c.once.Do(func() {
+		c.lock.Lock()
+		deadline := c.readDeadline
+		c.lock.Unlock()
+		if deadline.IsZero() {
+			c.Conn.SetReadDeadline(time.Now().Add(defaultClientReadWriteTimeout))
+		}
+		c.client, c.err = readProxyProtocolHeader(c.r)
+		if deadline.IsZero() {
+			c.lock.Lock()
+			c.Conn.SetReadDeadline(c.readDeadline)
+			c.lock.Unlock()
+		}
+		if c.err != nil {
+			c.p.proxyProtocolFailed(c.Conn, c.err)
+			c.Conn.Close()
+		}
+	})
+	return c.err
+}
+
+// Read .
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address of the PROXY protocol header, or the
+// address of the load balancer if the header has none, e.g. for health checks.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.client != nil {
+		return c.client
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// SetDeadline .
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline .
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// proxyProtocolFailed reports to the Delegate a connection rejected because
+// of its PROXY protocol header.
+func (p *Proxy) proxyProtocolFailed(conn net.Conn, err error) {
+	Logger.Errorf("PROXY protocol header from %s rejected: %s", conn.RemoteAddr(), err)
+	ctx := &Context{
+		Req: &http.Request{
+			URL:        &url.URL{},
+			Header:     make(http.Header),
+			RemoteAddr: conn.RemoteAddr().String(),
+		},
+		Data:       make(map[interface{}]interface{}),
+		ClientAddr: conn.RemoteAddr(),
+		PeerAddr:   conn.RemoteAddr(),
+	}
+	ctx.SetContextErrorWithType(err, ProxyProtocolFail)
+	p.delegate.Finish(ctx, newDiscardResponseWriter())
+}
+
+// clientAddrs returns the address of the client of conn and the one conn comes from,
+// which differ behind a load balancer sending PROXY protocol headers.
+func clientAddrs(conn net.Conn) (client net.Addr, peer net.Addr) {
+	if c, ok := conn.(*proxyProtocolConn); ok {
+		return c.RemoteAddr(), c.Conn.RemoteAddr()
+	}
+	return conn.RemoteAddr(), conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader reads a PROXY protocol v1 or v2 header from r, and
+// returns the source address it holds, nil for v1 UNKNOWN and v2 LOCAL headers.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("read PROXY protocol header: %w", err)
+	}
+	switch b[0] {
+	case 'P':
+		return readProxyProtocolV1(r)
+	case proxyProtocolV2Sig[0]:
+		return readProxyProtocolV2(r)
+	}
+	return nil, errors.New("no PROXY protocol header")
+}
+
+// readProxyProtocolV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLen {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("read PROXY protocol v1 header: %w", err)
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY protocol v1 header too long or not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", line)
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	_, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil || (src.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: src, Port: int(srcPort)}, nil
+}
+
+// readProxyProtocolV2 reads a binary header, whose TLVs are skipped.
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, fmt.Errorf("read PROXY protocol v2 header: %w", err)
+	}
+	if !bytes.Equal(head[:12], proxyProtocolV2Sig) {
+		return nil, errors.New("invalid PROXY protocol v2 signature")
+	}
+	if head[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", head[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("read PROXY protocol v2 addresses: %w", err)
+	}
+	switch head[12] & 0x0f {
+	case 0x00: // LOCAL, e.g. health checks of the load balancer
+		return nil, nil
+	case 0x01: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command %d", head[12]&0x0f)
+	}
+
+	var ip net.IP
+	var port int
+	switch head[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("short PROXY protocol v2 IPv4 addresses")
+		}
+		ip, port = net.IP(payload[0:4]), int(binary.BigEndian.Uint16(payload[8:10]))
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("short PROXY protocol v2 IPv6 addresses")
+		}
+		ip, port = net.IP(payload[0:16]), int(binary.BigEndian.Uint16(payload[32:34]))
+	case 0x0, 0x3: // AF_UNSPEC and AF_UNIX, which have no client address to use
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 address family %d", head[13]>>4)
+	}
+	switch head[13] & 0x0f {
+	case 0x1: // STREAM
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	case 0x2: // DGRAM
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return nil, fmt.Errorf("unsupported PROXY protocol v2 transport protocol %d", head[13]&0x0f)
+}
+
+// sendProxyProtocol writes to conn, a new connection to addr, the PROXY protocol
+// header SendProxyProtocol asks for, if any. dst is the address conn is connected
+// to, nil if it goes through a parent proxy. conn is closed if it fails.
+func (p *Proxy) sendProxyProtocol(conn net.Conn, addr string, client net.Addr, dst net.Addr) error {
+	version, ok := p.sendProxyProtocolTo[addr]
+	if !ok || client == nil {
+		return nil
+	}
+	if dst == nil {
+		host, port, _ := net.SplitHostPort(addr)
+		n, _ := strconv.Atoi(port)
+		dst = &net.TCPAddr{IP: net.ParseIP(host), Port: n}
+	}
+	conn.SetWriteDeadline(time.Now().Add(defaultTargetConnectTimeout))
+	_, err := conn.Write(proxyProtocolHeader(version, client, dst))
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("send PROXY protocol header to %s: %w", addr, err)
+	}
+	return nil
+}
+
+// proxyProtocolHeader returns the v1 or v2 header telling that client connected
+// to dst. A dst without an IP is the unspecified address of the family of client,
+// and mixed families are sent as IPv6.
+func proxyProtocolHeader(version int, client net.Addr, dst net.Addr) []byte {
+	srcIP, srcPort := addrIPPort(client)
+	dstIP, dstPort := addrIPPort(dst)
+	if srcIP == nil {
+		if version == 1 {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		return append(append([]byte{}, proxyProtocolV2Sig...), 0x20, 0x00, 0x00, 0x00)
+	}
+	if dstIP == nil {
+		dstIP = net.IPv6unspecified
+		if srcIP.To4() != nil {
+			dstIP = net.IPv4zero
+		}
+	}
+
+	src, dst4 := srcIP.To4(), dstIP.To4()
+	fam, v1Proto := byte(0x11), "TCP4" // AF_INET, STREAM
+	if src == nil || dst4 == nil {
+		fam, v1Proto = 0x21, "TCP6" // AF_INET6, STREAM
+		src, dstIP = srcIP.To16(), dstIP.To16()
+	} else {
+		dstIP = dst4
+	}
+	if version == 1 {
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", v1Proto, proxyProtocolV1IP(src), proxyProtocolV1IP(dstIP), srcPort, dstPort))
+	}
+	b := append([]byte{}, proxyProtocolV2Sig...)
+	b = append(b, 0x21, fam, 0, 0) // v2 PROXY
+	b = append(append(b, src...), dstIP...)
+	b = append(b, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+	binary.BigEndian.PutUint16(b[14:16], uint16(len(b)-16))
+	return b
+}
+
+// proxyProtocolV1IP formats ip, 4 or 16 bytes long, as TCP4 or TCP6 v1 headers want it.
+func proxyProtocolV1IP(ip net.IP) string {
+	if len(ip) == net.IPv6len && ip.To4() != nil {
+		// net.IP prints IPv4-mapped addresses in dotted notation only.
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
+
+// addrIPPort returns the IP and port of a TCP or UDP address, nil for other ones.
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
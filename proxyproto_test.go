@@ -0,0 +1,127 @@
+package proxychannel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// proxyProtocolV2 returns a v2 header with the given command, family and addresses.
+func proxyProtocolV2(cmd, fam byte, addrs ...byte) []byte {
+	b := append(append([]byte{}, proxyProtocolV2Sig...), 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(b[14:16], uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := append(append(append([]byte{}, net.ParseIP("2001:db8::1")...), net.ParseIP("2001:db8::2")...), 0xdc, 0x04, 0x01, 0xbb)
+	tests := []struct {
+		name    string
+		header  []byte
+		want    net.Addr
+		wantErr string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}, ""},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}, ""},
+		{"v1 unknown", []byte("PROXY UNKNOWN ff:: ff:: 1 2\r\n"), nil, ""},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n"), nil, "invalid PROXY protocol v1 header"},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"), nil, "invalid PROXY protocol v1 header"},
+		{"v1 missing field", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"), nil, "invalid PROXY protocol v1 header"},
+		{"v1 no CRLF", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), nil, "not terminated by CRLF"},
+		{"v1 too long", []byte("PROXY UNKNOWN " + strings.Repeat("x", proxyProtocolV1MaxLen) + "\r\n"), nil, "too long"},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1"), nil, "EOF"},
+		{"v2 tcp4", proxyProtocolV2(0x1, 0x11, ipv4...), &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}, ""},
+		{"v2 udp4", proxyProtocolV2(0x1, 0x12, ipv4...), &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}, ""},
+		{"v2 tcp6", proxyProtocolV2(0x1, 0x21, ipv6...), &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}, ""},
+		{"v2 with TLVs", proxyProtocolV2(0x1, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0xff)...), &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}, ""},
+		{"v2 local", proxyProtocolV2(0x0, 0x00), nil, ""},
+		{"v2 unspec", proxyProtocolV2(0x1, 0x00), nil, ""},
+		{"v2 short ipv4", proxyProtocolV2(0x1, 0x11, ipv4[:8]...), nil, "short PROXY protocol v2 IPv4 addresses"},
+		{"v2 short ipv6", proxyProtocolV2(0x1, 0x21, ipv4...), nil, "short PROXY protocol v2 IPv6 addresses"},
+		{"v2 bad command", proxyProtocolV2(0x2, 0x11, ipv4...), nil, "unsupported PROXY protocol v2 command 2"},
+		{"v2 bad family", proxyProtocolV2(0x1, 0x41, ipv4...), nil, "unsupported PROXY protocol v2 address family 4"},
+		{"v2 bad transport", proxyProtocolV2(0x1, 0x13, ipv4...), nil, "unsupported PROXY protocol v2 transport protocol 3"},
+		{"v2 bad version", append(append(append([]byte{}, proxyProtocolV2Sig...), 0x11, 0x11, 0, 12), ipv4...), nil, "unsupported PROXY protocol version 1"},
+		{"v2 bad signature", []byte("\r\n\r\n\x00\r\nQUIT!\x21\x11\x00\x00"), nil, "invalid PROXY protocol v2 signature"},
+		{"v2 truncated addresses", proxyProtocolV2(0x1, 0x11, ipv4...)[:20], nil, "read PROXY protocol v2 addresses"},
+		{"no header", []byte("GET / HTTP/1.1\r\n"), nil, "no PROXY protocol header"},
+		{"empty", nil, nil, "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(tt.header, "GET / HTTP/1.1\r\n"...)))
+			if tt.wantErr != "" {
+				r = bufio.NewReader(bytes.NewReader(tt.header))
+			}
+			got, err := readProxyProtocolHeader(r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || reflect.TypeOf(got) != reflect.TypeOf(tt.want) || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("readProxyProtocolHeader = %v, %v, want %v", got, err, tt.want)
+			}
+			if rest, _ := ioutil.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("data after the header = %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		client net.Addr
+		dst    net.Addr
+		v1     string
+		back   string // the client address read back from the v2 header
+	}{
+		{"ipv4", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+			"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324"},
+		{"ipv6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324"},
+		{"mixed families", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80},
+			"PROXY TCP6 2001:db8::1 ::ffff:10.0.0.1 5 80\r\n", "[2001:db8::1]:5"},
+		{"no ipv4 destination", &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5}, &net.TCPAddr{Port: 80},
+			"PROXY TCP4 10.0.0.2 0.0.0.0 5 80\r\n", "10.0.0.2:5"},
+		{"no ipv6 destination", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5}, nil,
+			"PROXY TCP6 2001:db8::1 :: 5 0\r\n", "[2001:db8::1]:5"},
+		{"unknown client", &net.UnixAddr{Name: "@", Net: "unix"}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80},
+			"PROXY UNKNOWN\r\n", "<nil>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v1 := proxyProtocolHeader(1, tt.client, tt.dst)
+			if string(v1) != tt.v1 {
+				t.Errorf("v1 header = %q, want %q", v1, tt.v1)
+			}
+			for version, header := range map[int][]byte{1: v1, 2: proxyProtocolHeader(2, tt.client, tt.dst)} {
+				got, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(header)))
+				if err != nil || fmt.Sprint(got) != tt.back {
+					t.Errorf("v%d header %q read back as %v, %v, want %s", version, header, got, err, tt.back)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyProtocolHeaderV2(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	want := proxyProtocolV2(0x1, 0x11, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb)
+	if got := proxyProtocolHeader(2, client, dst); !bytes.Equal(got, want) {
+		t.Errorf("v2 header = %x, want %x", got, want)
+	}
+	if got, want := proxyProtocolHeader(2, nil, dst), proxyProtocolV2(0x0, 0x00); !bytes.Equal(got, want) {
+		t.Errorf("v2 header of an unknown client = %x, want LOCAL %x", got, want)
+	}
+}
@@ -0,0 +1,281 @@
+package proxychannel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5PasswordVersion = 0x01
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyGeneralFailure      = 0x01
+	socks5ReplyNotAllowed          = 0x02
+	socks5ReplyNetworkUnreachable  = 0x03
+	socks5ReplyHostUnreachable     = 0x04
+	socks5ReplyConnectionRefused   = 0x05
+	socks5ReplyTTLExpired          = 0x06
+	socks5ReplyCommandNotSupported = 0x07
+	socks5ReplyAddrNotSupported    = 0x08
+)
+
+var socks5ReplyText = map[byte]string{
+	socks5ReplySucceeded:           "succeeded",
+	socks5ReplyGeneralFailure:      "general SOCKS server failure",
+	socks5ReplyNotAllowed:          "connection not allowed by ruleset",
+	socks5ReplyNetworkUnreachable:  "network unreachable",
+	socks5ReplyHostUnreachable:     "host unreachable",
+	socks5ReplyConnectionRefused:   "connection refused",
+	socks5ReplyTTLExpired:          "TTL expired",
+	socks5ReplyCommandNotSupported: "command not supported",
+	socks5ReplyAddrNotSupported:    "address type not supported",
+}
+
+var errSOCKS5AddrNotSupported = errors.New("address type not supported")
+
+// Stages of the SOCKS5 handshake that a SOCKS5Error can come from.
+const (
+	SOCKS5StageHandshake = "handshake"
+	SOCKS5StageAuth      = "auth"
+	SOCKS5StageConnect   = "connect"
+)
+
+// SOCKS5Error is returned when the SOCKS5 handshake with a parent proxy fails.
+type SOCKS5Error struct {
+	Proxy string // host:port of the SOCKS5 proxy
+	Stage string
+	Reply byte // reply code of the connect stage
+	Err   error
+}
+
+// Error .
+func (e *SOCKS5Error) Error() string {
+	return fmt.Sprintf("socks5 %s %s failed: %s", e.Proxy, e.Stage, e.Err)
+}
+
+// Unwrap .
+func (e *SOCKS5Error) Unwrap() error {
+	return e.Err
+}
+
+// socks5ErrType maps a SOCKS5Error to the ErrType of its stage.
+func socks5ErrType(err error) (string, bool) {
+	var socksErr *SOCKS5Error
+	if !errors.As(err, &socksErr) {
+		return "", false
+	}
+	switch socksErr.Stage {
+	case SOCKS5StageAuth:
+		return SOCKS5AuthFail, true
+	case SOCKS5StageConnect:
+		return SOCKS5ConnectFail, true
+	}
+	return SOCKS5HandshakeFail, true
+}
+
+// isSOCKS5 checks whether u is a socks5:// or socks5h:// proxy URL.
+func isSOCKS5(u *url.URL) bool {
+	return u != nil && (u.Scheme == "socks5" || u.Scheme == "socks5h")
+}
+
+// socks5Connect asks the SOCKS5 proxy at the other end of conn to connect to addr.
+// socks5:// URLs resolve addr locally, socks5h:// URLs let the proxy resolve it.
+func socks5Connect(ctx context.Context, conn net.Conn, proxyURL *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return fmt.Errorf("invalid port in %s", addr)
+	}
+	if proxyURL.Scheme == "socks5" && net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		host = ips[0].IP.String()
+		for _, ip := range ips {
+			if ip.IP.To4() != nil {
+				host = ip.IP.String()
+				break
+			}
+		}
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTargetConnectTimeout)
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	if err := socks5Auth(conn, proxyURL); err != nil {
+		return err
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	req, err = appendSOCKS5Addr(req, host, port)
+	if err != nil {
+		return &SOCKS5Error{Proxy: proxyURL.Host, Stage: SOCKS5StageConnect, Reply: socks5ReplyAddrNotSupported, Err: err}
+	}
+	if _, err := conn.Write(req); err != nil {
+		return &SOCKS5Error{Proxy: proxyURL.Host, Stage: SOCKS5StageHandshake, Err: err}
+	}
+	reply, _, _, err := readSOCKS5Reply(conn)
+	if err != nil {
+		return &SOCKS5Error{Proxy: proxyURL.Host, Stage: SOCKS5StageHandshake, Err: err}
+	}
+	if reply != socks5ReplySucceeded {
+		return &SOCKS5Error{Proxy: proxyURL.Host, Stage: SOCKS5StageConnect, Reply: reply, Err: fmt.Errorf("connect %s: %s", addr, socks5ReplyMessage(reply))}
+	}
+	return nil
+}
+
+// socks5Auth negotiates the authentication method, username/password
+// is offered when proxyURL has a user.
+func socks5Auth(conn net.Conn, proxyURL *url.URL) error {
+	methods := []byte{socks5AuthNone}
+	if proxyURL.User != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return &SOCKS5Error{Proxy: proxyURL.Host, Stage: SOCKS5StageHandshake, Err: err}
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return &SOCKS5Error{Proxy: proxyURL.Host, Stage: SOCKS5StageHandshake, Err: err}
+	}
+	if resp[0] != socks5Version {
+		return &SOCKS5Error{Proxy: proxyURL.Host, Stage: SOCKS5StageHandshake, Err: fmt.Errorf("unexpected protocol version %d", resp[0])}
+	}
+	switch resp[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if proxyURL.User == nil {
+			break
+		}
+		username := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+		if len(username) == 0 || len(username) > 255 || len(password) > 255 {
+			return &SOCKS5Error{Proxy: proxyURL.Host, Stage: SOCKS5StageAuth, Err: errors.New("invalid username/password")}
+		}
+		req := []byte{socks5PasswordVersion, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return &SOCKS5Error{Proxy: proxyURL.Host, Stage: SOCKS5StageAuth, Err: err}
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return &SOCKS5Error{Proxy: proxyURL.Host, Stage: SOCKS5StageAuth, Err: err}
+		}
+		if resp[1] != 0x00 {
+			return &SOCKS5Error{Proxy: proxyURL.Host, Stage: SOCKS5StageAuth, Err: errors.New("username/password rejected")}
+		}
+		return nil
+	}
+	return &SOCKS5Error{Proxy: proxyURL.Host, Stage: SOCKS5StageAuth, Err: errors.New("no acceptable authentication method")}
+}
+
+func socks5ReplyMessage(reply byte) string {
+	if text, ok := socks5ReplyText[reply]; ok {
+		return text
+	}
+	return fmt.Sprintf("unknown reply %d", reply)
+}
+
+// appendSOCKS5Addr appends the ATYP, address and port fields to b.
+func appendSOCKS5Addr(b []byte, host string, port int) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socks5AddrIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socks5AddrIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("host name too long: " + host)
+		}
+		b = append(b, socks5AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// readSOCKS5Addr reads the ATYP, address and port fields from r.
+func readSOCKS5Addr(r io.Reader) (host string, port int, err error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+	switch atyp[0] {
+	case socks5AddrIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		return "", 0, fmt.Errorf("%w: %d", errSOCKS5AddrNotSupported, atyp[0])
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(r, p[:]); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(p[:])), nil
+}
+
+// readSOCKS5Reply reads a reply to a SOCKS5 request and returns its code and bound address.
+func readSOCKS5Reply(r io.Reader) (reply byte, host string, port int, err error) {
+	var head [3]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, "", 0, err
+	}
+	if head[0] != socks5Version {
+		return 0, "", 0, fmt.Errorf("unexpected protocol version %d", head[0])
+	}
+	host, port, err = readSOCKS5Addr(r)
+	return head[1], host, port, err
+}
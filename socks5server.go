@@ -0,0 +1,393 @@
+package proxychannel
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SOCKS5Proto is the Proto of the Context.Req of SOCKS5 connections.
+const SOCKS5Proto = "SOCKS5"
+
+// SOCKS5UDPAssociate is the Method of the Context.Req of SOCKS5 UDP ASSOCIATE requests.
+const SOCKS5UDPAssociate = "UDP_ASSOCIATE"
+
+// ServeSOCKS5 accepts SOCKS5 connections on l and serves them with ServeSOCKS5Conn.
+// It returns when l is closed.
+func (p *Proxy) ServeSOCKS5(l net.Listener) error {
+	return serveConns(l, "ServeSOCKS5", p.ServeSOCKS5Conn)
+}
+
+// serveConns accepts connections on l and serves each of them in its own goroutine.
+// It returns when l is closed.
+func serveConns(l net.Listener, name string, serve func(net.Conn)) error {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// Back off like net/http does, e.g. when running out of file descriptors.
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				Logger.Errorf("%s accept failed: %s, retrying in %s", name, err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		delay = 0
+		go serve(conn)
+	}
+}
+
+// ServeSOCKS5Conn serves a SOCKS5 client connection. Its CONNECT goes through the
+// same Delegate lifecycle as an HTTP CONNECT that is tunneled, with a Context.Req
+// that is a CONNECT to the requested address. The username and password the client
+// authenticated with are its Basic Proxy-Authorization, and are checked by Auth.
+// The ResponseWriter given to the Delegate only records what is written to it,
+// an aborted SOCKS5 request is answered with "connection not allowed by ruleset".
+// UDP ASSOCIATE is served by socks5UDPAssociate once Connect and Auth passed.
+func (p *Proxy) ServeSOCKS5Conn(conn net.Conn) {
+	defer conn.Close()
+	atomic.AddInt32(&p.clientConnNum, 1)
+	defer atomic.AddInt32(&p.clientConnNum, -1)
+
+	conn.SetDeadline(time.Now().Add(defaultClientReadWriteTimeout))
+	user, err := p.socks5ServerAuth(conn)
+	if err != nil {
+		Logger.Errorf("ServeSOCKS5Conn %s handshake failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+	cmd, addr, err := readSOCKS5Request(conn)
+	if err != nil {
+		Logger.Errorf("ServeSOCKS5Conn %s read request failed: %s", conn.RemoteAddr(), err)
+		if errors.Is(err, errSOCKS5AddrNotSupported) {
+			writeSOCKS5Reply(conn, socks5ReplyAddrNotSupported, nil)
+		}
+		return
+	}
+	if cmd != socks5CmdConnect && cmd != socks5CmdUDPAssociate {
+		Logger.Errorf("ServeSOCKS5Conn %s command %d not supported", conn.RemoteAddr(), cmd)
+		writeSOCKS5Reply(conn, socks5ReplyCommandNotSupported, nil)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	rw := newDiscardResponseWriter()
+	ctx := &Context{
+		Req:    newSOCKS5Request(conn, cmd, addr, user),
+		Data:   make(map[interface{}]interface{}),
+		Hijack: true,
+	}
+	ctx.ClientAddr, ctx.PeerAddr = clientAddrs(conn)
+	defer p.delegate.Finish(ctx, rw)
+	p.delegate.Connect(ctx, rw)
+	if ctx.abort {
+		ctx.SetContextErrType(ConnectFail)
+		writeSOCKS5Reply(conn, socks5ReplyNotAllowed, nil)
+		return
+	}
+	p.delegate.Auth(ctx, rw)
+	if ctx.abort {
+		ctx.SetContextErrType(AuthFail)
+		writeSOCKS5Reply(conn, socks5ReplyNotAllowed, nil)
+		return
+	}
+
+	if cmd == socks5CmdUDPAssociate {
+		p.socks5UDPAssociate(ctx, conn)
+		return
+	}
+	reply := func(err error, addr net.Addr) error {
+		switch {
+		case err == nil:
+			return writeSOCKS5Reply(conn, socks5ReplySucceeded, addr)
+		case err == errTunnelAborted:
+			return writeSOCKS5Reply(conn, socks5ReplyNotAllowed, nil)
+		}
+		return writeSOCKS5Reply(conn, socks5DialReply(err), nil)
+	}
+	switch p.mode {
+	case NormalMode:
+		p.relayTunnel(ctx, rw, conn, reply)
+	case ConnPoolMode:
+		p.relayTunnelWithConnPool(ctx, conn, reply)
+	}
+}
+
+// errTunnelAborted is given to a tunnelReply when the Delegate aborted the tunnel.
+var errTunnelAborted = errors.New("tunnel aborted")
+
+// tunnelReply tells a client that needs no CONNECT response, e.g. a SOCKS5 one,
+// how connecting to its target went. err is nil once it is connected from addr.
+type tunnelReply func(err error, addr net.Addr) error
+
+// relayTunnel connects clientConn to ctx.Req.URL.Host like proxyTunnel does,
+// with reply instead of the CONNECT response.
+func (p *Proxy) relayTunnel(ctx *Context, rw http.ResponseWriter, clientConn net.Conn, reply tunnelReply) {
+	parentProxies, err := p.parentProxies(ctx, rw)
+	if ctx.abort {
+		ctx.SetContextErrType(ParentProxyFail)
+		reply(errTunnelAborted, nil)
+		return
+	}
+
+	targetAddr := ctx.Req.URL.Host
+	targetConn, err := p.dialTunnel(ctx, parentProxies, targetAddr)
+	p.delegate.BeforeResponse(ctx, &ConnWrapper{
+		Conn: targetConn,
+		Err:  err,
+	})
+	if ctx.abort {
+		if targetConn != nil {
+			targetConn.Close()
+		}
+		ctx.SetContextErrType(BeforeResponseFail)
+		reply(errTunnelAborted, nil)
+		return
+	}
+	if err != nil {
+		Logger.Errorf("relayTunnel %s dial remote server failed: %s", targetAddr, err)
+		reply(err, nil)
+		ctx.SetContextErrorWithType(err, upstreamErrType(err, TunnelDialRemoteServerFail))
+		return
+	}
+	defer targetConn.Close()
+
+	p.delegate.DuringResponse(ctx, &TunnelConn{Client: clientConn, Target: targetConn}) // targetConn could be closed in this method
+	if err := reply(nil, targetConn.LocalAddr()); err != nil {
+		Logger.Errorf("relayTunnel %s write reply failed: %s", targetAddr, err)
+		ctx.SetContextErrorWithType(err, TunnelWriteEstRespFail)
+		return
+	}
+	transfer(ctx, clientConn, targetConn)
+}
+
+// relayTunnelWithConnPool connects clientConn to ctx.Req.URL.Host through a parent
+// proxy of the ConnPool, trying another one when it fails like
+// proxyTunnelWithConnPool does, with reply instead of the CONNECT response.
+func (p *Proxy) relayTunnelWithConnPool(ctx *Context, clientConn net.Conn, reply tunnelReply) {
+	poolChoices, err := p.delegate.GetConnPool(ctx)
+	if err != nil {
+		Logger.Errorf("relayTunnelWithConnPool %s GetConnPool failed: %s", ctx.Req.URL.Host, err)
+		reply(err, nil)
+		ctx.SetPoolContextErrorWithType(err, PoolGetConnPoolFail)
+		return
+	}
+
+	err = p.tunnelWithConnPools(ctx, clientConn, poolChoices, func(pool ConnPool, parentProxyURL *url.URL, targetConn net.Conn) bool {
+		proxyTag := pool.GetTag()
+		dialCtx, cancel := context.WithTimeout(context.Background(), defaultTargetConnectTimeout)
+		tunnel, err := tunnelThrough(dialCtx, targetConn, parentProxyURL, ctx.Req.URL.Host)
+		if err == nil {
+			targetConn = tunnel
+			err = p.sendProxyProtocol(targetConn, ctx.Req.URL.Host, ctx.ClientAddr, nil)
+		}
+		cancel()
+		p.delegate.DuringResponse(ctx, &TunnelInfo{Client: clientConn, Target: targetConn, Err: err, ParentProxy: parentProxyURL, Pool: pool}) // targetConn could be closed in this method
+		if err != nil {
+			Logger.Errorf("relayTunnelWithConnPool %s connect through %s(%s) failed: %s", ctx.Req.URL.Host, parentProxyURL.Host, proxyTag, err)
+			ctx.SetPoolContextErrorWithType(err, upstreamErrType(err, PoolParentProxyFail), proxyTag)
+			targetConn.Close()
+			return false
+		}
+
+		if err := reply(nil, targetConn.LocalAddr()); err != nil {
+			Logger.Errorf("relayTunnelWithConnPool %s write reply failed: %s", ctx.Req.URL.Host, err)
+			ctx.SetPoolContextErrorWithType(err, PoolWriteClientFail, proxyTag)
+			targetConn.Close()
+			return true
+		}
+		transfer(ctx, clientConn, targetConn, proxyTag)
+		targetConn.Close()
+		return true
+	})
+	if err == errTunnelAborted {
+		ctx.SetPoolContextErrorWithType(nil, BeforeResponseFail)
+		reply(errTunnelAborted, nil)
+		return
+	}
+	if err != nil {
+		Logger.Errorf("relayTunnelWithConnPool %s cannot find working parent proxy to forward request", ctx.Req.URL.Host)
+		reply(err, nil)
+		ctx.SetPoolContextErrorWithType(nil, PoolNoAvailableParentProxyFail)
+	}
+}
+
+// socks5ServerAuth negotiates the authentication method with a SOCKS5 client
+// and returns the user it authenticated as, if any. Username/password is
+// required with SOCKS5RequireAuth, and otherwise used if it is all the client offers.
+func (p *Proxy) socks5ServerAuth(conn net.Conn) (*url.Userinfo, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != socks5Version {
+		return nil, fmt.Errorf("unexpected protocol version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if m == socks5AuthPassword {
+			method = socks5AuthPassword
+		} else if m == socks5AuthNone && !p.socks5RequireAuth && method == socks5AuthNoAcceptable {
+			method = socks5AuthNone
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+	switch method {
+	case socks5AuthNone:
+		return nil, nil
+	case socks5AuthNoAcceptable:
+		return nil, errors.New("no acceptable authentication method")
+	}
+
+	// RFC 1929. The credentials are checked by Delegate.Auth once the request
+	// is known, so the sub-negotiation itself always succeeds.
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return nil, err
+	}
+	if b[0] != socks5PasswordVersion {
+		return nil, fmt.Errorf("unexpected username/password version %d", b[0])
+	}
+	username := make([]byte, b[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return nil, err
+	}
+	password := make([]byte, b[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{socks5PasswordVersion, 0x00}); err != nil {
+		return nil, err
+	}
+	return url.UserPassword(string(username), string(password)), nil
+}
+
+// readSOCKS5Request reads the request of a SOCKS5 client, and returns its command and address.
+func readSOCKS5Request(r io.Reader) (byte, string, error) {
+	var head [3]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, "", err
+	}
+	if head[0] != socks5Version {
+		return 0, "", fmt.Errorf("unexpected protocol version %d", head[0])
+	}
+	host, port, err := readSOCKS5Addr(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return head[1], net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// writeSOCKS5Reply answers a SOCKS5 request, with the bound address addr if it is a TCP or UDP address.
+func writeSOCKS5Reply(w io.Writer, reply byte, addr net.Addr) error {
+	ip, port := net.IPv4zero, 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	b, _ := appendSOCKS5Addr([]byte{socks5Version, reply, 0x00}, ip.String(), port)
+	_, err := w.Write(b)
+	return err
+}
+
+// socks5DialReply maps the error of dialing a target to a SOCKS5 reply code.
+func socks5DialReply(err error) byte {
+	var socksErr *SOCKS5Error
+	if errors.As(err, &socksErr) && socksErr.Stage == SOCKS5StageConnect && socksErr.Reply != socks5ReplySucceeded {
+		return socksErr.Reply
+	}
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socks5ReplyHostUnreachable
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return socks5ReplyTTLExpired
+	}
+	return socks5ReplyGeneralFailure
+}
+
+// newSOCKS5Request returns the Context.Req of a SOCKS5 CONNECT to addr, or of a
+// UDP ASSOCIATE whose client sends datagrams from addr.
+func newSOCKS5Request(conn net.Conn, cmd byte, addr string, user *url.Userinfo) *http.Request {
+	method := http.MethodConnect
+	if cmd == socks5CmdUDPAssociate {
+		method = SOCKS5UDPAssociate
+	}
+	req := &http.Request{
+		Method:     method,
+		URL:        &url.URL{Host: addr},
+		Proto:      SOCKS5Proto,
+		Header:     make(http.Header),
+		Host:       addr,
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	return req
+}
+
+// discardResponseWriter is the ResponseWriter given to the Delegate for connections
+// that have no HTTP response, e.g. SOCKS5 ones. It records the status and discards the body.
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func newDiscardResponseWriter() *discardResponseWriter {
+	return &discardResponseWriter{header: make(http.Header)}
+}
+
+// Header .
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// Write .
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+// WriteHeader .
+func (w *discardResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
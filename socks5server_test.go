@@ -0,0 +1,64 @@
+package proxychannel
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadSOCKS5Request(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     []byte
+		cmd     byte
+		addr    string
+		wantErr string
+	}{
+		{"ipv4", []byte{5, 1, 0, 1, 10, 0, 0, 1, 0x01, 0xbb}, socks5CmdConnect, "10.0.0.1:443", ""},
+		{"ipv6", append(append([]byte{5, 1, 0, 4}, net.ParseIP("2001:db8::1")...), 0x00, 0x50), socks5CmdConnect, "[2001:db8::1]:80", ""},
+		{"domain", append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 0x1f, 0x90), socks5CmdConnect, "example.com:8080", ""},
+		{"udp associate", []byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}, socks5CmdUDPAssociate, "0.0.0.0:0", ""},
+		{"unsupported address type", []byte{5, 1, 0, 9, 0, 0}, 0, "", errSOCKS5AddrNotSupported.Error()},
+		{"wrong version", []byte{4, 1, 0, 1, 10, 0, 0, 1, 0, 80}, 0, "", "unexpected protocol version 4"},
+		{"short address", []byte{5, 1, 0, 1, 10, 0}, 0, "", "unexpected EOF"},
+		{"short domain", append([]byte{5, 1, 0, 3, 11}, "example"...), 0, "", "unexpected EOF"},
+		{"empty", nil, 0, "", "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, addr, err := readSOCKS5Request(bytes.NewReader(tt.req))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || cmd != tt.cmd || addr != tt.addr {
+				t.Fatalf("readSOCKS5Request = %d, %q, %v, want %d, %q", cmd, addr, err, tt.cmd, tt.addr)
+			}
+		})
+	}
+}
+
+func TestWriteSOCKS5Reply(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		host string
+		port int
+	}{
+		{nil, "0.0.0.0", 0},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1080}, "127.0.0.1", 1080},
+		{&net.UDPAddr{IP: net.ParseIP("::1"), Port: 53}, "::1", 53},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		if err := writeSOCKS5Reply(&b, socks5ReplyHostUnreachable, tt.addr); err != nil {
+			t.Fatal(err)
+		}
+		reply, host, port, err := readSOCKS5Reply(&b)
+		if err != nil || reply != socks5ReplyHostUnreachable || host != tt.host || port != tt.port {
+			t.Errorf("reply to %v read back as %d, %s, %d, %v", tt.addr, reply, host, port, err)
+		}
+	}
+}
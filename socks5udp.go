@@ -0,0 +1,256 @@
+package proxychannel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxUDPDatagramSize is the largest UDP payload, plus the SOCKS5 header of relayed datagrams.
+const maxUDPDatagramSize = 65535
+
+// socks5UDPAssociation relays the datagrams of a SOCKS5 UDP ASSOCIATE.
+// The client sends them to relay, wrapped in a SOCKS5 UDP header, and they
+// go out of target. The replies of the destinations come back the other way.
+type socks5UDPAssociation struct {
+	p       *Proxy
+	ctx     *Context
+	control net.Conn
+	relay   *net.UDPConn
+	target  *net.UDPConn
+
+	clientIP   net.IP // the address the client said it sends from,
+	clientPort int    // unspecified ones match any
+	lock       sync.Mutex
+	clientAddr *net.UDPAddr    // where the first datagram came from
+	peers      map[string]bool // resolved destinations that may answer
+
+	// destinations are only used by relayToTarget.
+	destinations map[string]*net.UDPAddr // nil for denied ones
+
+	lastActive int64 // UnixNano
+	closeOnce  sync.Once
+}
+
+// socks5UDPAssociate serves a SOCKS5 UDP ASSOCIATE. The datagrams are relayed
+// by the proxy itself in both modes, to the destinations Delegate.AllowUDP allows.
+// The association lasts until the client closes its TCP connection, or no
+// datagram was relayed for SOCKS5UDPIdleTimeout.
+func (p *Proxy) socks5UDPAssociate(ctx *Context, clientConn net.Conn) {
+	// Listen on the address the client reached the proxy at, which it can send to.
+	var relayAddr net.UDPAddr
+	if addr, ok := clientConn.LocalAddr().(*net.TCPAddr); ok {
+		relayAddr.IP = addr.IP
+	}
+	relay, err := net.ListenUDP("udp", &relayAddr)
+	if err != nil {
+		Logger.Errorf("socks5UDPAssociate listen relay failed: %s", err)
+		writeSOCKS5Reply(clientConn, socks5ReplyGeneralFailure, nil)
+		ctx.SetContextErrorWithType(err, SOCKS5UDPListenFail)
+		return
+	}
+	defer relay.Close()
+	target, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		Logger.Errorf("socks5UDPAssociate listen target failed: %s", err)
+		writeSOCKS5Reply(clientConn, socks5ReplyGeneralFailure, nil)
+		ctx.SetContextErrorWithType(err, SOCKS5UDPListenFail)
+		return
+	}
+	defer target.Close()
+
+	a := &socks5UDPAssociation{
+		p:            p,
+		ctx:          ctx,
+		control:      clientConn,
+		relay:        relay,
+		target:       target,
+		peers:        make(map[string]bool),
+		destinations: make(map[string]*net.UDPAddr),
+		lastActive:   time.Now().UnixNano(),
+	}
+	if host, port, err := net.SplitHostPort(ctx.Req.URL.Host); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			a.clientIP = ip
+		}
+		a.clientPort, _ = strconv.Atoi(port)
+	}
+	if a.clientIP == nil {
+		if addr, ok := clientConn.RemoteAddr().(*net.TCPAddr); ok {
+			a.clientIP = addr.IP
+		}
+	}
+
+	if err := writeSOCKS5Reply(clientConn, socks5ReplySucceeded, relay.LocalAddr()); err != nil {
+		Logger.Errorf("socks5UDPAssociate write reply failed: %s", err)
+		ctx.SetContextErrorWithType(err, TunnelWriteEstRespFail)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// The client closing its TCP connection ends the association.
+		io.Copy(ioutil.Discard, clientConn)
+		a.close()
+	}()
+	go func() {
+		defer wg.Done()
+		a.relayToClient()
+	}()
+	a.relayToTarget()
+	wg.Wait()
+}
+
+// close ends the association.
+func (a *socks5UDPAssociation) close() {
+	a.closeOnce.Do(func() {
+		a.control.Close()
+		a.relay.Close()
+		a.target.Close()
+	})
+}
+
+// readFrom reads a datagram from conn, and tells whether the association
+// should end because it failed or timed out.
+func (a *socks5UDPAssociation) readFrom(conn *net.UDPConn, b []byte) (int, *net.UDPAddr, bool) {
+	idleTimeout := a.p.socks5UDPIdleTimeout
+	for {
+		conn.SetReadDeadline(time.Unix(0, atomic.LoadInt64(&a.lastActive)).Add(idleTimeout))
+		n, from, err := conn.ReadFromUDP(b)
+		if err == nil {
+			return n, from, false
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if time.Since(time.Unix(0, atomic.LoadInt64(&a.lastActive))) < idleTimeout {
+				// The other direction was active meanwhile.
+				continue
+			}
+			Logger.Infof("socks5UDPAssociate %s idle for %s", a.ctx.Req.RemoteAddr, idleTimeout)
+			a.ctx.SetContextErrType(SOCKS5UDPIdleTimeout)
+		} else if !errors.Is(err, net.ErrClosed) {
+			Logger.Errorf("socks5UDPAssociate %s read failed: %s", a.ctx.Req.RemoteAddr, err)
+			a.ctx.SetContextErrorWithType(err, SOCKS5UDPRelayFail)
+		}
+		a.close()
+		return 0, nil, true
+	}
+}
+
+// relayToTarget sends the datagrams of the client to their destinations.
+func (a *socks5UDPAssociation) relayToTarget() {
+	buf := make([]byte, maxUDPDatagramSize)
+	for {
+		n, from, done := a.readFrom(a.relay, buf)
+		if done {
+			return
+		}
+		if !a.fromClient(from) {
+			Logger.Warningf("socks5UDPAssociate %s drop datagram from %s", a.ctx.Req.RemoteAddr, from)
+			continue
+		}
+		addr, payload, err := parseSOCKS5UDP(buf[:n])
+		if err != nil {
+			Logger.Warningf("socks5UDPAssociate %s drop datagram: %s", a.ctx.Req.RemoteAddr, err)
+			continue
+		}
+		dst := a.destination(addr)
+		if dst == nil {
+			continue
+		}
+		atomic.StoreInt64(&a.lastActive, time.Now().UnixNano())
+		if _, err := a.target.WriteToUDP(payload, dst); err != nil {
+			Logger.Errorf("socks5UDPAssociate %s write to %s failed: %s", a.ctx.Req.RemoteAddr, addr, err)
+			continue
+		}
+		a.ctx.ReqLength += int64(len(payload))
+	}
+}
+
+// relayToClient sends the datagrams of the destinations back to the client.
+func (a *socks5UDPAssociation) relayToClient() {
+	buf := make([]byte, maxUDPDatagramSize)
+	for {
+		n, from, done := a.readFrom(a.target, buf)
+		if done {
+			return
+		}
+		a.lock.Lock()
+		clientAddr, ok := a.clientAddr, a.peers[from.String()]
+		a.lock.Unlock()
+		if !ok || clientAddr == nil {
+			Logger.Warningf("socks5UDPAssociate %s drop datagram from %s", a.ctx.Req.RemoteAddr, from)
+			continue
+		}
+		atomic.StoreInt64(&a.lastActive, time.Now().UnixNano())
+		b, _ := appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, from.IP.String(), from.Port)
+		if _, err := a.relay.WriteToUDP(append(b, buf[:n]...), clientAddr); err != nil {
+			Logger.Errorf("socks5UDPAssociate %s write to client failed: %s", a.ctx.Req.RemoteAddr, err)
+			continue
+		}
+		a.ctx.RespLength += int64(n)
+	}
+}
+
+// fromClient checks whether a datagram sent to the relay comes from the client.
+// The first one that does fixes the client address.
+func (a *socks5UDPAssociation) fromClient(from *net.UDPAddr) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.clientAddr != nil {
+		return from.IP.Equal(a.clientAddr.IP) && from.Port == a.clientAddr.Port
+	}
+	if a.clientIP != nil && !from.IP.Equal(a.clientIP) || a.clientPort != 0 && from.Port != a.clientPort {
+		return false
+	}
+	a.clientAddr = from
+	return true
+}
+
+// destination returns the resolved address of addr, or nil if the Delegate
+// does not allow it.
+func (a *socks5UDPAssociation) destination(addr string) *net.UDPAddr {
+	if dst, ok := a.destinations[addr]; ok {
+		return dst
+	}
+	if !a.p.delegate.AllowUDP(a.ctx, addr) {
+		Logger.Infof("socks5UDPAssociate %s to %s not allowed", a.ctx.Req.RemoteAddr, addr)
+		a.destinations[addr] = nil
+		return nil
+	}
+	dst, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		Logger.Errorf("socks5UDPAssociate %s resolve %s failed: %s", a.ctx.Req.RemoteAddr, addr, err)
+		return nil
+	}
+	a.destinations[addr] = dst
+	a.lock.Lock()
+	a.peers[dst.String()] = true
+	a.lock.Unlock()
+	return dst
+}
+
+// parseSOCKS5UDP returns the destination and payload of a datagram sent to
+// a SOCKS5 UDP relay. Fragments are not supported.
+func parseSOCKS5UDP(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("short SOCKS5 UDP header")
+	}
+	if b[2] != 0x00 {
+		return "", nil, fmt.Errorf("SOCKS5 UDP fragment %d not supported", b[2])
+	}
+	r := bytes.NewReader(b[3:])
+	host, port, err := readSOCKS5Addr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), b[len(b)-r.Len():], nil
+}
@@ -0,0 +1,147 @@
+package proxychannel
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSOCKS5UDP(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		addr    string
+		payload string
+		wantErr string
+	}{
+		{"ipv4", []byte{0, 0, 0, 1, 127, 0, 0, 1, 0, 53, 'h', 'i'}, "127.0.0.1:53", "hi", ""},
+		{"ipv6", append(append([]byte{0, 0, 0, 4}, net.ParseIP("::1")...), 0, 53, 'h', 'i'), "[::1]:53", "hi", ""},
+		{"domain", append([]byte{0, 0, 0, 3, 7}, "example\x01\xbbhi"...), "example:443", "hi", ""},
+		{"empty payload", []byte{0, 0, 0, 1, 127, 0, 0, 1, 0, 53}, "127.0.0.1:53", "", ""},
+		{"fragment", []byte{0, 0, 1, 1, 127, 0, 0, 1, 0, 53}, "", "", "fragment 1 not supported"},
+		{"short header", []byte{0, 0, 0}, "", "", "short SOCKS5 UDP header"},
+		{"short address", []byte{0, 0, 0, 1, 127, 0}, "", "", "unexpected EOF"},
+		{"unsupported address type", []byte{0, 0, 0, 9, 0, 0}, "", "", errSOCKS5AddrNotSupported.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, payload, err := parseSOCKS5UDP(tt.b)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || addr != tt.addr || string(payload) != tt.payload {
+				t.Fatalf("parseSOCKS5UDP = %q, %q, %v, want %q, %q", addr, payload, err, tt.addr, tt.payload)
+			}
+		})
+	}
+}
+
+type udpTestDelegate struct {
+	DefaultDelegate
+	deny     string
+	finished chan *Context
+}
+
+func (d *udpTestDelegate) AllowUDP(ctx *Context, addr string) bool {
+	return addr != d.deny
+}
+
+func (d *udpTestDelegate) Finish(ctx *Context, rw http.ResponseWriter) {
+	d.finished <- ctx
+}
+
+// listenUDPEcho starts a loopback UDP server answering "echo:" and what it got.
+func listenUDPEcho(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, maxUDPDatagramSize)
+		for {
+			n, from, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(append([]byte("echo:"), b[:n]...), from)
+		}
+	}()
+	return conn
+}
+
+func TestSOCKS5UDPAssociateEcho(t *testing.T) {
+	echo := listenUDPEcho(t)
+	defer echo.Close()
+	denied := listenUDPEcho(t)
+	defer denied.Close()
+
+	d := &udpTestDelegate{deny: denied.LocalAddr().String(), finished: make(chan *Context, 1)}
+	hconf := *DefaultHandlerConfig
+	hconf.Delegate = d
+	hconf.Transport = nil
+	p := NewProxy(&hconf, NewExtensionManager(map[string]Extension{}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go p.ServeSOCKS5(l)
+
+	control, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+	control.Write([]byte{socks5Version, 1, socks5AuthNone})
+	method := make([]byte, 2)
+	if _, err := control.Read(method); err != nil || method[1] != socks5AuthNone {
+		t.Fatalf("auth negotiation = %v, %v", method, err)
+	}
+	control.Write([]byte{socks5Version, socks5CmdUDPAssociate, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	reply, host, port, err := readSOCKS5Reply(control)
+	if err != nil || reply != socks5ReplySucceeded {
+		t.Fatalf("UDP ASSOCIATE reply = %d, %v", reply, err)
+	}
+	relay := &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	send := func(dst *net.UDPConn, payload string) {
+		b, _ := appendSOCKS5Addr([]byte{0, 0, 0}, "127.0.0.1", dst.LocalAddr().(*net.UDPAddr).Port)
+		if _, err := client.WriteToUDP(append(b, payload...), relay); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(denied, "denied")
+	send(echo, "hello")
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, maxUDPDatagramSize)
+	n, _, err := client.ReadFromUDP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, payload, err := parseSOCKS5UDP(b[:n])
+	if err != nil || addr != echo.LocalAddr().String() || string(payload) != "echo:hello" {
+		t.Fatalf("relayed reply = %q, %q, %v", addr, payload, err)
+	}
+
+	control.Close()
+	select {
+	case ctx := <-d.finished:
+		if ctx.Req.Method != SOCKS5UDPAssociate || ctx.ReqLength != int64(len("hello")) || ctx.RespLength != int64(len("echo:hello")) {
+			t.Errorf("finished %s with %d bytes sent and %d received", ctx.Req.Method, ctx.ReqLength, ctx.RespLength)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("association did not end with its control connection")
+	}
+}
@@ -0,0 +1,282 @@
+package proxychannel
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransparentProto is the Proto of the Context.Req of transparently proxied
+// connections that are not HTTP.
+const TransparentProto = "TRANSPARENT"
+
+// transparentSniffTimeout is how long a transparent connection may stay silent
+// before it is relayed as is, the server speaks first in some protocols.
+const transparentSniffTimeout = time.Second
+
+// recordTypeHandshake is the type of the TLS records a ClientHello is sent in.
+const recordTypeHandshake = 0x16
+
+// ServeTransparent accepts connections redirected to l by iptables and serves
+// them with ServeTransparentConn. It returns when l is closed.
+func (p *Proxy) ServeTransparent(l net.Listener) error {
+	return serveConns(l, "ServeTransparent", p.ServeTransparentConn)
+}
+
+// ServeTransparentConn serves a connection redirected by iptables REDIRECT,
+// or accepted by a TPROXY listener, see ListenTransparent. Clients have no
+// proxy configured, the target is the original destination of conn.
+// HTTP requests are proxied like those sent to ServeHTTP. TLS connections go through
+// the same Delegate lifecycle as an HTTP CONNECT to the SNI, and are tunneled or
+// decrypted. Anything else is relayed to the original destination as is.
+func (p *Proxy) ServeTransparentConn(conn net.Conn) {
+	dst, err := originalDst(conn)
+	if err != nil {
+		Logger.Errorf("ServeTransparentConn %s get original destination failed: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	p.serveRedirected(conn, dst)
+}
+
+// serveRedirected sniffs what conn, which was sent to dst, speaks and serves it.
+func (p *Proxy) serveRedirected(conn net.Conn, dst *net.TCPAddr) {
+	// A ClientHello fits in a TLS record of up to 16K.
+	br := bufio.NewReaderSize(conn, 5+16384)
+	sniffed := &sniffedConn{Conn: conn, r: br}
+	conn.SetReadDeadline(time.Now().Add(transparentSniffTimeout))
+	head, err := br.Peek(1)
+	if err != nil && !isTimeout(err) {
+		Logger.Errorf("serveRedirected %s read failed: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	switch {
+	case len(head) == 0:
+		conn.SetReadDeadline(time.Time{})
+		p.serveTransparentTunnel(sniffed, dst.String(), nil)
+	case head[0] == recordTypeHandshake:
+		conn.SetReadDeadline(time.Now().Add(defaultClientReadWriteTimeout))
+		hello := sniffClientHello(br)
+		conn.SetReadDeadline(time.Time{})
+		host := dst.IP.String()
+		if hello != nil && hello.ServerName != "" {
+			host = hello.ServerName
+		}
+		p.serveTransparentTunnel(sniffed, net.JoinHostPort(host, strconv.Itoa(dst.Port)), hello)
+	default:
+		buffered, _ := br.Peek(br.Buffered())
+		conn.SetReadDeadline(time.Time{})
+		if isHTTPRequestPrefix(buffered) {
+			p.serveTransparentHTTP(sniffed, dst)
+		} else {
+			p.serveTransparentTunnel(sniffed, dst.String(), nil)
+		}
+	}
+}
+
+// serveTransparentHTTP proxies the HTTP requests read from clientConn, to the
+// host of their Host header and the port of their original destination dst.
+func (p *Proxy) serveTransparentHTTP(clientConn net.Conn, dst *net.TCPAddr) {
+	port := strconv.Itoa(dst.Port)
+	l := newOneConnListener(clientConn)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			host := req.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if host == "" {
+				host = dst.IP.String()
+			}
+			req.URL.Scheme = "http"
+			req.URL.Host = host
+			if dst.Port != 80 {
+				req.URL.Host = net.JoinHostPort(host, port)
+			}
+			req.Host = req.URL.Host
+			p.ServeHTTP(rw, req)
+		}),
+		IdleTimeout: defaultClientReadWriteTimeout,
+		ConnState:   l.connState,
+	}
+	srv.Serve(l)
+}
+
+// serveTransparentTunnel connects clientConn to addr like an HTTP CONNECT to
+// it, or decrypts it when it is TLS and should be MITM'd.
+func (p *Proxy) serveTransparentTunnel(clientConn net.Conn, addr string, hello *ClientHello) {
+	defer clientConn.Close()
+	atomic.AddInt32(&p.clientConnNum, 1)
+	defer atomic.AddInt32(&p.clientConnNum, -1)
+
+	rw := newDiscardResponseWriter()
+	ctx := &Context{
+		Req: &http.Request{
+			Method:     http.MethodConnect,
+			URL:        &url.URL{Host: addr},
+			Proto:      TransparentProto,
+			Header:     make(http.Header),
+			Host:       addr,
+			RemoteAddr: clientConn.RemoteAddr().String(),
+		},
+		Data:        make(map[interface{}]interface{}),
+		Hijack:      true,
+		ClientHello: hello,
+	}
+	ctx.ClientAddr, ctx.PeerAddr = clientAddrs(clientConn)
+	defer p.delegate.Finish(ctx, rw)
+	p.delegate.Connect(ctx, rw)
+	if ctx.abort {
+		ctx.SetContextErrType(ConnectFail)
+		return
+	}
+	p.delegate.Auth(ctx, rw)
+	if ctx.abort {
+		ctx.SetContextErrType(AuthFail)
+		return
+	}
+
+	// There is no one to reply to, clients think they are connected to the target already.
+	reply := func(error, net.Addr) error { return nil }
+	switch p.mode {
+	case NormalMode:
+		if hello != nil {
+			ctx.MITM = p.mitmByConfig(ctx)
+			ctx.MITM = p.delegate.ShouldMITM(ctx)
+		}
+		if !ctx.MITM {
+			p.relayTunnel(ctx, rw, clientConn, reply)
+			return
+		}
+		tlsConfig, err := p.mitmTLSConfig(ctx, HTTPSGenerateTLSConfigFail)
+		if err != nil {
+			Logger.Errorf("serveTransparentTunnel %s generate tlsConfig failed: %s", addr, err)
+			ctx.SetContextErrorWithType(err, HTTPSGenerateTLSConfigFail)
+			return
+		}
+		p.serveMITM(ctx, rw, clientConn, tlsConfig)
+	case ConnPoolMode:
+		p.relayTunnelWithConnPool(ctx, clientConn, reply)
+	}
+}
+
+// sniffClientHello returns what the ClientHello at the start of r offers, or nil
+// if there is none. It is peeked at, r still reads it.
+func sniffClientHello(r *bufio.Reader) *ClientHello {
+	header, err := r.Peek(5)
+	if err != nil {
+		return nil
+	}
+	record, err := r.Peek(5 + (int(header[3])<<8 | int(header[4])))
+	if err != nil {
+		return nil
+	}
+	var hello *ClientHello
+	// Parse it with crypto/tls, stopping as soon as the ClientHello is read.
+	tls.Server(&sniffedConn{r: bufio.NewReader(bytes.NewReader(record))}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &ClientHello{
+				ServerName:        h.ServerName,
+				SupportedProtos:   h.SupportedProtos,
+				CipherSuites:      h.CipherSuites,
+				SupportedVersions: h.SupportedVersions,
+			}
+			return nil, errSniffed
+		},
+	}).Handshake()
+	return hello
+}
+
+var errSniffed = errors.New("sniffed")
+
+// isHTTPRequestPrefix checks whether b could be the start of an HTTP request line.
+func isHTTPRequestPrefix(b []byte) bool {
+	for i, c := range b {
+		switch {
+		case c >= 'A' && c <= 'Z':
+		case c == ' ':
+			return i > 0
+		default:
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+// sniffedConn is a connection whose first bytes were peeked at, or read ahead, with r.
+// Without a Conn, it only reads r and discards what is written to it.
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read .
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Write .
+func (c *sniffedConn) Write(b []byte) (int, error) {
+	if c.Conn == nil {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// Close .
+func (c *sniffedConn) Close() error {
+	if c.Conn == nil {
+		return nil
+	}
+	return c.Conn.Close()
+}
+
+// oneConnListener is a net.Listener accepting a single connection, and closed
+// once an http.Server is done with it.
+type oneConnListener struct {
+	conn     net.Conn
+	accepted bool
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newOneConnListener(conn net.Conn) *oneConnListener {
+	return &oneConnListener{conn: conn, done: make(chan struct{})}
+}
+
+// Accept .
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+// Close .
+func (l *oneConnListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr .
+func (l *oneConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// connState is the http.Server.ConnState that closes l with its connection.
+func (l *oneConnListener) connState(conn net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		l.Close()
+	}
+}
@@ -0,0 +1,97 @@
+//go:build linux
+// +build linux
+
+package proxychannel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Options of linux/netfilter_ipv4.h, netfilter_ipv6/ip6_tables.h and linux/in6.h.
+const (
+	soOriginalDst     = 80
+	ip6tSOOriginalDst = 80
+	ipv6Transparent   = 75
+)
+
+// ListenTransparent listens for the connections iptables redirects to addr.
+// With tproxy, IP_TRANSPARENT is set so that iptables TPROXY can hand over
+// connections to other addresses, which needs CAP_NET_ADMIN.
+func ListenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if err == nil && network == "tcp6" {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			}); cerr != nil {
+				return cerr
+			}
+			if err != nil {
+				return fmt.Errorf("set IP_TRANSPARENT: %w", err)
+			}
+			return nil
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst returns the address conn was sent to before iptables redirected it.
+// Connections accepted by a TPROXY listener keep it as their local address.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a TCP connection", conn)
+	}
+	local := tc.LocalAddr().(*net.TCPAddr)
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var dst *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if transparent, err := syscall.GetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT); err == nil && transparent != 0 {
+			dst = local
+			return
+		}
+		if local.IP.To4() != nil {
+			// struct sockaddr_in fits in the bytes of an ipv6_mreq.
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			a := mreq.Multiaddr
+			dst = &net.TCPAddr{IP: net.IPv4(a[4], a[5], a[6], a[7]), Port: int(a[2])<<8 | int(a[3])}
+			return
+		}
+		// And struct sockaddr_in6 in those of an ip6_mtuinfo.
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSOOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		dst = &net.TCPAddr{IP: append(net.IP(nil), info.Addr.Addr[:]...), Port: int(port[0])<<8 | int(port[1])}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", err)
+	}
+	if dst != local && dst.IP.Equal(local.IP) && dst.Port == local.Port {
+		// Sent to the proxy itself, relaying it would loop.
+		return nil, errors.New("connection was not redirected")
+	}
+	return dst, nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package proxychannel
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentNotSupported = errors.New("transparent proxy is only supported on Linux")
+
+// ListenTransparent listens for the connections iptables redirects to addr,
+// which is only supported on Linux.
+func ListenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	return nil, errTransparentNotSupported
+}
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentNotSupported
+}
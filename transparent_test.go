@@ -0,0 +1,208 @@
+package proxychannel
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first TLS record a client with config sends.
+func clientHello(t *testing.T, config *tls.Config) []byte {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		tls.Client(clientConn, config).Handshake()
+	}()
+	defer clientConn.Close()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(serverConn, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(serverConn, record); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, record...)
+}
+
+func TestSniffClientHello(t *testing.T) {
+	withSNI := clientHello(t, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+	withoutSNI := clientHello(t, &tls.Config{InsecureSkipVerify: true})
+	tests := []struct {
+		name  string
+		b     []byte
+		want  *ClientHello // only ServerName and SupportedProtos are compared
+		found bool
+	}{
+		{"sni", withSNI, &ClientHello{ServerName: "example.com", SupportedProtos: []string{"h2", "http/1.1"}}, true},
+		{"no sni", withoutSNI, &ClientHello{}, true},
+		{"truncated", withSNI[:len(withSNI)-1], nil, false},
+		{"short header", withSNI[:3], nil, false},
+		{"not a handshake", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(bytes.NewReader(tt.b), 5+16384)
+			hello := sniffClientHello(r)
+			if found := hello != nil; found != tt.found {
+				t.Fatalf("sniffClientHello = %+v, want found %v", hello, tt.found)
+			}
+			if hello != nil && (hello.ServerName != tt.want.ServerName || !reflect.DeepEqual(hello.SupportedProtos, tt.want.SupportedProtos)) {
+				t.Errorf("sniffClientHello = %q %q, want %q %q", hello.ServerName, hello.SupportedProtos, tt.want.ServerName, tt.want.SupportedProtos)
+			}
+			if hello != nil && len(hello.CipherSuites) == 0 {
+				t.Error("no cipher suites sniffed")
+			}
+			if rest, _ := ioutil.ReadAll(r); !bytes.Equal(rest, tt.b) {
+				t.Errorf("%d bytes left to read after sniffing, want %d", len(rest), len(tt.b))
+			}
+		})
+	}
+}
+
+func TestIsHTTPRequestPrefix(t *testing.T) {
+	tests := []struct {
+		b    string
+		want bool
+	}{
+		{"GET / HTTP/1.1\r\n", true},
+		{"OPTIONS * HTTP/1.1\r\n", true},
+		{"PRI", true},
+		{"G", true},
+		{"", false},
+		{" GET /", false},
+		{"get / HTTP/1.1", false},
+		{"SSH-2.0-OpenSSH_8.9\r\n", false},
+		{"\x16\x03\x01\x02\x00", false},
+		{"\x00\x01\x02\x03", false},
+	}
+	for _, tt := range tests {
+		if got := isHTTPRequestPrefix([]byte(tt.b)); got != tt.want {
+			t.Errorf("isHTTPRequestPrefix(%q) = %v, want %v", tt.b, got, tt.want)
+		}
+	}
+}
+
+type transparentTestDelegate struct {
+	DefaultDelegate
+	finished chan *Context
+}
+
+// Connect aborts TLS connections, they would be tunneled to their SNI.
+func (d *transparentTestDelegate) Connect(ctx *Context, rw http.ResponseWriter) {
+	if ctx.ClientHello != nil {
+		ctx.Abort()
+	}
+}
+
+func (d *transparentTestDelegate) Finish(ctx *Context, rw http.ResponseWriter) {
+	d.finished <- ctx
+}
+
+// listenGreeter starts a loopback server that speaks first with greeting,
+// then echoes what it gets.
+func listenGreeter(t *testing.T, greeting string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(greeting))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestServeRedirected(t *testing.T) {
+	const greeting = "220 ready\r\n"
+	greeter := listenGreeter(t, greeting)
+	defer greeter.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("hello from origin"))
+	}))
+	defer origin.Close()
+	greeterAddr := greeter.Addr().(*net.TCPAddr)
+	originAddr := origin.Listener.Addr().(*net.TCPAddr)
+
+	tests := []struct {
+		name   string
+		dst    *net.TCPAddr
+		send   []byte
+		reply  string // read back in full, or found in what HTTP clients read
+		method string
+		host   string
+		proto  string
+		sni    string
+	}{
+		{"http request", originAddr, []byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n"), "hello from origin",
+			http.MethodGet, originAddr.String(), "HTTP/1.1", ""},
+		{"silent client of a server-first protocol", greeterAddr, nil, greeting,
+			http.MethodConnect, greeterAddr.String(), TransparentProto, ""},
+		{"binary prefix", greeterAddr, []byte("\x00\x01\x02\x03"), greeting + "\x00\x01\x02\x03",
+			http.MethodConnect, greeterAddr.String(), TransparentProto, ""},
+		{"tls with sni", greeterAddr, clientHello(t, &tls.Config{ServerName: "example.com"}), "",
+			http.MethodConnect, net.JoinHostPort("example.com", strconv.Itoa(greeterAddr.Port)), TransparentProto, "example.com"},
+		{"tls without sni", greeterAddr, clientHello(t, &tls.Config{InsecureSkipVerify: true}), "",
+			http.MethodConnect, greeterAddr.String(), TransparentProto, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &transparentTestDelegate{finished: make(chan *Context, 1)}
+			hconf := *DefaultHandlerConfig
+			hconf.Delegate = d
+			hconf.Transport = nil
+			p := NewProxy(&hconf, NewExtensionManager(map[string]Extension{}))
+
+			clientConn, proxyConn := net.Pipe()
+			defer clientConn.Close()
+			go p.serveRedirected(proxyConn, tt.dst)
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			if len(tt.send) > 0 {
+				if _, err := clientConn.Write(tt.send); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := make([]byte, len(tt.reply))
+			if tt.proto == TransparentProto {
+				io.ReadFull(clientConn, got)
+			} else {
+				got, _ = ioutil.ReadAll(clientConn)
+			}
+			if !strings.Contains(string(got), tt.reply) {
+				t.Errorf("read back %q, want %q", got, tt.reply)
+			}
+			clientConn.Close()
+
+			select {
+			case ctx := <-d.finished:
+				if ctx.Req.Method != tt.method || ctx.Req.Host != tt.host || ctx.Req.Proto != tt.proto {
+					t.Errorf("served as %s %s %s, want %s %s %s", ctx.Req.Method, ctx.Req.Host, ctx.Req.Proto, tt.method, tt.host, tt.proto)
+				}
+				if isTLS := len(tt.send) > 0 && tt.send[0] == recordTypeHandshake; isTLS && (ctx.ClientHello == nil || ctx.ClientHello.ServerName != tt.sni) {
+					t.Errorf("ClientHello = %+v, want SNI %s", ctx.ClientHello, tt.sni)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("connection was not served")
+			}
+		})
+	}
+}
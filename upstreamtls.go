@@ -0,0 +1,225 @@
+package proxychannel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// isUpstreamCertError checks whether err was caused by an origin certificate
+// that could not be verified against the upstream trust store.
+func isUpstreamCertError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
+
+// upstreamClientCertError is the error of a request or handshake whose origin
+// asked for a client certificate and then rejected it with an alert.
+type upstreamClientCertError struct {
+	err error
+}
+
+func (e *upstreamClientCertError) Error() string {
+	return "after a client certificate request: " + e.err.Error()
+}
+
+func (e *upstreamClientCertError) Unwrap() error {
+	return e.err
+}
+
+// upstreamErrType returns the ErrType of the SOCKS5 stage that failed,
+// ParentProxyHopFail if a hop of the parent proxy chain failed otherwise,
+// UpstreamCertVerifyFail or UpstreamClientCertFail if err was caused by the
+// certificates of the TLS handshake with the origin, errType otherwise.
+func upstreamErrType(err error, errType string) string {
+	if t, ok := socks5ErrType(err); ok {
+		return t
+	}
+	var hopErr *ParentProxyError
+	if errors.As(err, &hopErr) {
+		return ParentProxyHopFail
+	}
+	if isUpstreamCertError(err) {
+		return UpstreamCertVerifyFail
+	}
+	var certErr *upstreamClientCertError
+	if errors.As(err, &certErr) {
+		return UpstreamClientCertFail
+	}
+	return errType
+}
+
+// upstreamHandshakeKey is the context key of the upstreamHandshake of a request
+// or of a handshake with an origin.
+type upstreamHandshakeKey struct{}
+
+// upstreamHandshake tells getUpstreamClientCertificate the origin host, which is
+// how it knows which client certificate to present, and records whether the
+// origin asked for one.
+type upstreamHandshake struct {
+	host          string
+	certRequested int32
+}
+
+// context returns parent with h as its upstreamHandshake.
+func (h *upstreamHandshake) context(parent context.Context) context.Context {
+	return context.WithValue(parent, upstreamHandshakeKey{}, h)
+}
+
+// result returns err, as an upstreamClientCertError if the origin asked for a
+// client certificate and err is the alert it rejected it with. The alert ends
+// the handshake with TLS 1.2, and comes after it, on the first read, with TLS 1.3.
+func (h *upstreamHandshake) result(err error) error {
+	if err != nil && atomic.LoadInt32(&h.certRequested) == 1 && isClientCertAlert(err) {
+		return &upstreamClientCertError{err: err}
+	}
+	return err
+}
+
+// clientCertAlerts are the errors of the alerts rejecting a client certificate,
+// as crypto/tls reports them.
+var clientCertAlerts = map[string]bool{
+	"tls: bad certificate":               true,
+	"tls: unsupported certificate":       true,
+	"tls: revoked certificate":           true,
+	"tls: expired certificate":           true,
+	"tls: unknown certificate":           true,
+	"tls: unknown certificate authority": true,
+	"tls: certificate required":          true,
+}
+
+// isClientCertAlert checks whether err is an alert from the peer rejecting a client certificate.
+func isClientCertAlert(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error" && clientCertAlerts[opErr.Err.Error()]
+}
+
+// handshakeUpstream runs the client handshake of tlsConn with the origin host,
+// within the connect timeout.
+func handshakeUpstream(tlsConn *tls.Conn, host string) error {
+	h := &upstreamHandshake{host: host}
+	ctx, cancel := context.WithTimeout(h.context(context.Background()), defaultTargetConnectTimeout)
+	defer cancel()
+	return h.result(tlsConn.HandshakeContext(ctx))
+}
+
+// upstreamClientCert returns the client certificate of host,
+// chosen by the longest matching pattern of UpstreamClientCerts.
+func (p *Proxy) upstreamClientCert(host string) *tls.Certificate {
+	var cert *tls.Certificate
+	var longest int
+	for pattern, c := range p.upstreamClientCerts {
+		if len(pattern) > longest && matchHostPattern(pattern, host) {
+			cert, longest = c, len(pattern)
+		}
+	}
+	return cert
+}
+
+// getUpstreamClientCertificate is the GetClientCertificate of the upstream tls.Config.
+// Without a certificate for the host, it picks one of Certificates like crypto/tls does.
+func (p *Proxy) getUpstreamClientCertificate(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	var host string
+	if h, ok := cri.Context().Value(upstreamHandshakeKey{}).(*upstreamHandshake); ok {
+		atomic.StoreInt32(&h.certRequested, 1)
+		host = h.host
+	}
+	if cert := p.upstreamClientCert(host); cert != nil {
+		return cert, nil
+	}
+	for i := range p.upstreamCertificates {
+		if cri.SupportsCertificate(&p.upstreamCertificates[i]) == nil {
+			return &p.upstreamCertificates[i], nil
+		}
+	}
+	// An empty certificate makes the origin decide whether to go on without one.
+	Logger.Warningf("Upstream %s asked for a client certificate, but none is configured", host)
+	return &tls.Certificate{}, nil
+}
+
+// loadUpstreamRoots returns roots, or the system pool if it is nil,
+// with the PEM bundles in caFiles added.
+func loadUpstreamRoots(roots *x509.CertPool, caFiles []string) (*x509.CertPool, error) {
+	if roots == nil {
+		var err error
+		roots, err = x509.SystemCertPool()
+		if err != nil {
+			Logger.Warningf("Load system cert pool failed: %s", err)
+			roots = x509.NewCertPool()
+		}
+	}
+	for _, name := range caFiles {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s contains no PEM certificate", name)
+		}
+	}
+	return roots, nil
+}
+
+// setupUpstreamTLS makes p.transport log session keys, present client certificates and verify
+// origin certificates, and prepares an unverified copy of it for the hosts
+// in UpstreamInsecureHosts.
+func (p *Proxy) setupUpstreamTLS(hconf *HandlerConfig) error {
+	if p.transport.TLSClientConfig == nil {
+		p.transport.TLSClientConfig = &tls.Config{}
+	}
+	if p.keyLogWriter != nil {
+		p.transport.TLSClientConfig.KeyLogWriter = p.keyLogWriter
+	}
+	// It is installed without UpstreamClientCerts too, to know whether the origin
+	// of a failed request asked for a client certificate.
+	if len(hconf.UpstreamClientCerts) > 0 || p.transport.TLSClientConfig.GetClientCertificate == nil {
+		p.upstreamClientCerts = hconf.UpstreamClientCerts
+		p.upstreamCertificates = p.transport.TLSClientConfig.Certificates
+		p.transport.TLSClientConfig.GetClientCertificate = p.getUpstreamClientCertificate
+	}
+	if p.transport.TLSClientConfig.InsecureSkipVerify {
+		return nil
+	}
+	roots, err := loadUpstreamRoots(p.transport.TLSClientConfig.RootCAs, hconf.UpstreamCAFiles)
+	if err != nil {
+		return err
+	}
+	p.transport.TLSClientConfig.RootCAs = roots
+	if len(hconf.UpstreamInsecureHosts) > 0 {
+		p.upstreamInsecureHosts = hconf.UpstreamInsecureHosts
+		p.insecureTransport = p.transport.Clone()
+		p.insecureTransport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return nil
+}
+
+// transportFor returns the transport that forwards requests to host.
+func (p *Proxy) transportFor(host string) *http.Transport {
+	if p.insecureTransport != nil && matchHostPatterns(p.upstreamInsecureHosts, host) {
+		return p.insecureTransport
+	}
+	return p.transport
+}
+
+// upstreamTLSConfig returns the config for dialing addr over TLS without the transport,
+// verified the same way as the requests sent through it. The client certificate
+// is picked during the handshake, which should be run with handshakeUpstream.
+func (p *Proxy) upstreamTLSConfig(addr string) *tls.Config {
+	c := p.transportFor(addr).TLSClientConfig.Clone()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if c.ServerName == "" {
+		c.ServerName = host
+	}
+	return c
+}
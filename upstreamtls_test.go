@@ -0,0 +1,49 @@
+package proxychannel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestUpstreamHandshakeResult(t *testing.T) {
+	alert := func(text string) error {
+		return &net.OpError{Op: "remote error", Err: errors.New(text)}
+	}
+	tests := []struct {
+		name          string
+		certRequested bool
+		err           error
+		want          bool
+	}{
+		{"bad certificate", true, alert("tls: bad certificate"), true},
+		{"certificate required", true, alert("tls: certificate required"), true},
+		{"unknown ca", true, alert("tls: unknown certificate authority"), true},
+		{"alert without certificate request", false, alert("tls: bad certificate"), false},
+		{"other alert", true, alert("tls: handshake failure"), false},
+		{"reset", true, &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, false},
+		{"eof", true, io.EOF, false},
+		{"timeout", true, context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &upstreamHandshake{host: "example.com"}
+			if tt.certRequested {
+				h.certRequested = 1
+			}
+			err := h.result(tt.err)
+			var certErr *upstreamClientCertError
+			if got := errors.As(err, &certErr); got != tt.want {
+				t.Fatalf("result(%v) = %v, client certificate error %v, want %v", tt.err, err, got, tt.want)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("result(%v) = %v, does not wrap the original error", tt.err, err)
+			}
+		})
+	}
+	if err := (&upstreamHandshake{certRequested: 1}).result(nil); err != nil {
+		t.Errorf("result(nil) = %v", err)
+	}
+}
@@ -54,3 +54,16 @@ func (w *WriterWithLength) Write(b []byte) (n int, err error) {
 func (w *WriterWithLength) Length() int {
 	return w.length
 }
+
+// flushWriter flushes after every write, so that streamed responses reach the client at once.
+type flushWriter struct {
+	w io.Writer
+}
+
+func (fw *flushWriter) Write(b []byte) (n int, err error) {
+	n, err = fw.w.Write(b)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}